@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
@@ -10,10 +11,26 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// MongoDB error codes for an index that exists with different options
+const (
+	indexOptionsConflict  = 85
+	indexKeySpecsConflict = 86
+)
+
 var (
-	Client      *mongo.Client
-	UsersCol    *mongo.Collection
-	ExpensesCol *mongo.Collection
+	Client         *mongo.Client
+	Database       *mongo.Database
+	UsersCol       *mongo.Collection
+	ExpensesCol    *mongo.Collection
+	RatesCol       *mongo.Collection
+	CategoriesCol  *mongo.Collection
+	RecurringCol   *mongo.Collection
+	CommentsCol    *mongo.Collection
+	EventsCol      *mongo.Collection
+	WebhooksCol    *mongo.Collection
+	DeliveriesCol  *mongo.Collection
+	SettlementsCol *mongo.Collection
+	BudgetsCol     *mongo.Collection
 )
 
 func InitMongoDB(uri string) {
@@ -34,33 +51,243 @@ func InitMongoDB(uri string) {
 
 	Client = client
 	db := client.Database("expenses_db")
+	Database = db
 	UsersCol = db.Collection("users")
 	ExpensesCol = db.Collection("expenses")
+	RatesCol = db.Collection("exchange_rates")
+	CategoriesCol = db.Collection("categories")
+	RecurringCol = db.Collection("recurring_expenses")
+	CommentsCol = db.Collection("comments")
+	EventsCol = db.Collection("events")
+	WebhooksCol = db.Collection("webhooks")
+	DeliveriesCol = db.Collection("webhook_deliveries")
+	SettlementsCol = db.Collection("settlements")
+	BudgetsCol = db.Collection("budgets")
 
+	migrateExpenseDates()
+	migrateExpenseSortFields()
 	createIndexes()
 }
 
+// migrateExpenseDates backfills expense_date from created_at for expenses
+// recorded before expenses carried their own date
+func migrateExpenseDates() {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	_, err := ExpensesCol.UpdateMany(ctx,
+		bson.M{"expense_date": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"expense_date": "$created_at"}}}},
+	)
+	if err != nil {
+		log.Printf("Failed to backfill expense_date: %v", err)
+	}
+}
+
+// migrateExpenseSortFields sets text fields expenses can be sorted by to "" where
+// older expenses lack them. Keyset pagination compares them with $gt and $lt,
+// which never match a missing field.
+func migrateExpenseSortFields() {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	for _, field := range []string{"description", "category", "split_type"} {
+		_, err := ExpensesCol.UpdateMany(ctx,
+			bson.M{field: nil},
+			bson.M{"$set": bson.M{field: ""}},
+		)
+		if err != nil {
+			log.Printf("Failed to backfill %s: %v", field, err)
+		}
+	}
+}
+
 func createIndexes() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Unique index on email
+	// Unique indexes on email and mobile_number. They are partial because
+	// placeholder users and merge tombstones may lack one or both fields.
+	for _, field := range []string{"email", "mobile_number"} {
+		if err := createPartialUniqueIndex(ctx, UsersCol, field); err != nil {
+			log.Printf("Failed to create index on %s: %v", field, err)
+		}
+	}
+
+	// Index on name for user search and name lookups
 	_, err := UsersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.M{"email": 1},
-		Options: options.Index().SetUnique(true),
+		Keys: bson.M{"name": 1},
 	})
 	if err != nil {
-		log.Printf("Failed to create index on email: %v", err)
+		log.Printf("Failed to create index on name: %v", err)
+	}
+
+	// Indexes on replaced identifiers so old emails and mobile numbers still resolve
+	for _, field := range []string{"previous_emails.value", "previous_mobile_numbers.value"} {
+		_, err = UsersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.M{field: 1},
+		})
+		if err != nil {
+			log.Printf("Failed to create index on %s: %v", field, err)
+		}
 	}
 
-	// Unique index on mobile_number
+	// Text index for word matches in user search
 	_, err = UsersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.M{"mobile_number": 1},
+		Keys: bson.D{{Key: "name", Value: "text"}, {Key: "email", Value: "text"}},
+	})
+	if err != nil {
+		log.Printf("Failed to create text index on users: %v", err)
+	}
+
+	// One rate per currency pair and effective date
+	_, err = RatesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}, {Key: "effective_date", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create index on exchange_rates: %v", err)
+	}
+
+	// Custom category names are unique per user
+	_, err = CategoriesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_by", Value: 1}, {Key: "name", Value: 1}},
 		Options: options.Index().SetUnique(true),
 	})
 	if err != nil {
-		log.Printf("Failed to create index on mobile_number: %v", err)
+		log.Printf("Failed to create index on categories: %v", err)
+	}
+
+	// Index on category for filtering expenses
+	_, err = ExpensesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"category": 1},
+	})
+	if err != nil {
+		log.Printf("Failed to create index on category: %v", err)
+	}
+
+	// Multikey index on tags for tag filtering
+	_, err = ExpensesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"tags": 1},
+	})
+	if err != nil {
+		log.Printf("Failed to create index on tags: %v", err)
+	}
+
+	// Indexes backing the expense listing filters and sorts
+	expenseIndexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "amount", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expense_date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "created_by", Value: 1}, {Key: "expense_date", Value: -1}}},
+		{Keys: bson.D{{Key: "participants", Value: 1}, {Key: "expense_date", Value: -1}}},
+		{Keys: bson.D{{Key: "description", Value: "text"}}},
+	}
+	if _, err := ExpensesCol.Indexes().CreateMany(ctx, expenseIndexes); err != nil {
+		log.Printf("Failed to create expense listing indexes: %v", err)
+	}
+
+	// One expense per recurring expense occurrence, so the scheduler can safely retry
+	_, err = ExpensesCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "recurring_id", Value: 1}, {Key: "expense_date", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"recurring_id": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Failed to create index on recurring_id: %v", err)
+	}
+
+	// Comment threads are listed oldest first
+	_, err = CommentsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "expense_id", Value: 1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index on comments: %v", err)
+	}
+
+	// Activity feeds list a user's events newest first
+	_, err = EventsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "users", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index on events: %v", err)
+	}
+
+	// Indexes for the webhook delivery queue and per-webhook delivery logs
+	deliveryIndexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	}
+	if _, err := DeliveriesCol.Indexes().CreateMany(ctx, deliveryIndexes); err != nil {
+		log.Printf("Failed to create webhook delivery indexes: %v", err)
+	}
+
+	// Settlements are looked up by either side when computing balances
+	settlementIndexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "payer", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "payee", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	}
+	if _, err := SettlementsCol.Indexes().CreateMany(ctx, settlementIndexes); err != nil {
+		log.Printf("Failed to create settlement indexes: %v", err)
+	}
+
+	// One budget per user, category and currency
+	_, err = BudgetsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user", Value: 1}, {Key: "currency", Value: 1}, {Key: "category", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create index on budgets: %v", err)
+	}
+
+	// Unsubscribe links look users up by token
+	_, err = UsersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"unsubscribe_token": 1},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"unsubscribe_token": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Failed to create index on unsubscribe_token: %v", err)
+	}
+
+	// Index for the digest scheduler's due query
+	_, err = UsersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "last_digest_at", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index on last_digest_at: %v", err)
+	}
+
+	// Index for the scheduler's due query
+	_, err = RecurringCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "paused", Value: 1}, {Key: "next_run", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index on recurring_expenses: %v", err)
+	}
+}
+
+// createPartialUniqueIndex creates a unique index on field covering only documents
+// where it is a non-empty string, replacing an older full unique index on the field
+func createPartialUniqueIndex(ctx context.Context, col *mongo.Collection, field string) error {
+	model := mongo.IndexModel{
+		Keys: bson.M{field: 1},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{field: bson.M{"$gt": ""}}),
+	}
+	_, err := col.Indexes().CreateOne(ctx, model)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == indexOptionsConflict || cmdErr.Code == indexKeySpecsConflict) {
+		if _, err := col.Indexes().DropOne(ctx, field+"_1"); err != nil {
+			return err
+		}
+		_, err = col.Indexes().CreateOne(ctx, model)
+		return err
 	}
+	return err
 }
 
 func CloseMongoDB() {
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ActivityItem is an event in a user's activity feed
+type ActivityItem struct {
+	models.Event
+	Unread bool `json:"unread"`
+}
+
+// ActivityPage is a page of the activity feed with the user's total unread count
+type ActivityPage struct {
+	Page[ActivityItem]
+	UnreadCount int64 `json:"unread_count"`
+}
+
+// ActivityReadInput is the body of marking a user's activity feed as read
+type ActivityReadInput struct {
+	Identifier string `json:"identifier" binding:"required"`
+}
+
+// GetActivity handles listing the events concerning the user given by the
+// 'identifier' query parameter, newest first. Optional 'type' (comma-separated)
+// and 'expense_id' query parameters narrow the feed.
+func GetActivity(c *gin.Context) {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identifier (email, mobile_number, or name) is required"})
+		return
+	}
+
+	user, err := identifyUser(identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	filter := bson.M{"users": user.ID}
+	if types := strings.TrimSpace(c.Query("type")); types != "" {
+		filter["type"] = bson.M{"$in": strings.Split(types, ",")}
+	}
+	if expenseID := c.Query("expense_id"); expenseID != "" {
+		id, err := primitive.ObjectIDFromHex(expenseID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expense_id"})
+			return
+		}
+		filter["expense_id"] = id
+	}
+
+	params, err := parsePageParams(c, maxPageLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	page, err := findPage(ctx, db.EventsCol, filter, sort, params, func(e models.Event) bson.D {
+		return bson.D{{Key: "created_at", Value: e.CreatedAt}, {Key: "_id", Value: e.ID}}
+	})
+	if err != nil {
+		if errors.Is(err, errCursorSortMismatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve activity"})
+		return
+	}
+
+	// Events the user caused are never unread
+	unreadFilter := bson.M{"users": user.ID, "actor": bson.M{"$ne": user.ID}}
+	if user.ActivityReadAt != nil {
+		unreadFilter["created_at"] = bson.M{"$gt": *user.ActivityReadAt}
+	}
+	unreadCount, err := db.EventsCol.CountDocuments(ctx, unreadFilter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread activity"})
+		return
+	}
+
+	result := ActivityPage{
+		Page: Page[ActivityItem]{
+			Data:       make([]ActivityItem, 0, len(page.Data)),
+			NextCursor: page.NextCursor,
+			PrevCursor: page.PrevCursor,
+			Total:      page.Total,
+		},
+		UnreadCount: unreadCount,
+	}
+	for _, event := range page.Data {
+		unread := (event.Actor == nil || *event.Actor != user.ID) &&
+			(user.ActivityReadAt == nil || event.CreatedAt.After(*user.ActivityReadAt))
+		result.Data = append(result.Data, ActivityItem{Event: event, Unread: unread})
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// MarkActivityRead handles marking every event in a user's activity feed as read
+func MarkActivityRead(c *gin.Context) {
+	var input ActivityReadInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := identifyUser(input.Identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	if _, err := db.UsersCol.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"activity_read_at": now}}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark activity as read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"read_at": now, "unread_count": 0})
+}
+
+// recordEvent stores an event for the activity feeds of the users it concerns,
+// pushes it to their event streams and queues it for subscribed webhooks. The
+// change it describes has already been written, so failures are only logged.
+func recordEvent(event models.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	event.Users = uniqueIDs(event.Users)
+	result, err := db.EventsCol.InsertOne(ctx, event)
+	if err != nil {
+		log.Printf("Failed to record %s event: %v", event.Type, err)
+		return
+	}
+	event.ID = result.InsertedID.(primitive.ObjectID)
+
+	if streamHub.inProcess.Load() {
+		streamHub.publish(event)
+	}
+	enqueueWebhookDeliveries(ctx, event)
+}
+
+// expenseEvent builds an event about an expense, concerning its creator and participants
+func expenseEvent(eventType string, expense models.Expense, actor *primitive.ObjectID, data bson.M) models.Event {
+	if data == nil {
+		data = bson.M{}
+	}
+	data["description"] = expense.Description
+	data["amount"] = expense.Amount
+	data["currency"] = expense.Currency
+	expenseID := expense.ID
+	return models.Event{
+		Type:      eventType,
+		Actor:     actor,
+		Users:     append([]primitive.ObjectID{expense.CreatedBy}, expense.Participants...),
+		ExpenseID: &expenseID,
+		Data:      data,
+	}
+}
+
+// uniqueIDs drops repeated IDs, keeping the first occurrence
+func uniqueIDs(ids []primitive.ObjectID) []primitive.ObjectID {
+	result := []primitive.ObjectID{}
+	seen := map[primitive.ObjectID]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/storage"
+	"expenses-backend/utils"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxAttachmentSize        = 10 << 20 // 10 MiB
+	maxAttachmentsPerExpense = 10
+	thumbnailSize            = 256
+)
+
+// allowedAttachmentTypes are the accepted attachment types, as sniffed from the
+// content; the client's Content-Type is not trusted
+var allowedAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// attachmentStore holds attachment contents; see SetAttachmentStore
+var attachmentStore storage.BlobStore
+
+// SetAttachmentStore sets the blob storage used for expense attachments
+func SetAttachmentStore(store storage.BlobStore) {
+	attachmentStore = store
+}
+
+// UploadAttachment handles attaching a file, sent as the multipart form field 'file', to an expense
+func UploadAttachment(c *gin.Context) {
+	expenseID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expense id"})
+		return
+	}
+
+	// Leave room for the multipart framing around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+1<<20)
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Attachment exceeds " + strconv.Itoa(maxAttachmentSize>>20) + " MB"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Multipart form field 'file' is required"})
+		return
+	}
+	if fileHeader.Size > maxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Attachment exceeds " + strconv.Itoa(maxAttachmentSize>>20) + " MB"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	file.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	if len(data) > maxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Attachment exceeds " + strconv.Itoa(maxAttachmentSize>>20) + " MB"})
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !allowedAttachmentTypes[contentType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported attachment type '" + contentType + "', use JPEG, PNG, GIF, WebP or PDF"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var expense models.Expense
+	if err := db.ExpensesCol.FindOne(ctx, bson.M{"_id": expenseID}).Decode(&expense); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Expense not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch expense"})
+		return
+	}
+	if len(expense.Attachments) >= maxAttachmentsPerExpense {
+		c.JSON(http.StatusConflict, gin.H{"error": "Expense already has " + strconv.Itoa(maxAttachmentsPerExpense) + " attachments"})
+		return
+	}
+
+	attachment := models.Attachment{
+		ID:          primitive.NewObjectID(),
+		FileName:    attachmentFileName(fileHeader.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now(),
+	}
+	key := attachmentKey(expenseID, attachment.ID)
+	if err := attachmentStore.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return
+	}
+
+	// A missing thumbnail is not fatal, e.g. WebP can't be decoded here
+	if strings.HasPrefix(contentType, "image/") {
+		if thumb, err := utils.Thumbnail(data, thumbnailSize); err == nil {
+			if err := attachmentStore.Put(ctx, key+"_thumb", bytes.NewReader(thumb)); err == nil {
+				attachment.HasThumbnail = true
+			}
+		}
+	}
+
+	// Re-check the limit atomically in case of concurrent uploads
+	filter := bson.M{
+		"_id": expenseID,
+		"attachments." + strconv.Itoa(maxAttachmentsPerExpense-1): bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$push": bson.M{"attachments": attachment},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	result, err := db.ExpensesCol.UpdateOne(ctx, filter, update)
+	if err != nil || result.MatchedCount == 0 {
+		deleteAttachmentBlobs(ctx, key, attachment.HasThumbnail)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Expense already has " + strconv.Itoa(maxAttachmentsPerExpense) + " attachments"})
+		return
+	}
+
+	recordEvent(expenseEvent(models.EventExpenseUpdated, expense, nil, bson.M{"change": "attachment_added", "file_name": attachment.FileName}))
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// DownloadAttachment handles downloading an attachment, or its thumbnail with 'thumbnail=true'
+func DownloadAttachment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	expense, attachment, ok := findAttachment(ctx, c)
+	if !ok {
+		return
+	}
+
+	key := attachmentKey(expense.ID, attachment.ID)
+	contentType, size := attachment.ContentType, attachment.Size
+	disposition := "attachment"
+	if c.Query("thumbnail") == "true" {
+		if !attachment.HasThumbnail {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment has no thumbnail"})
+			return
+		}
+		key, contentType, size, disposition = key+"_thumb", "image/jpeg", -1, "inline"
+	}
+
+	reader, err := attachmentStore.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment contents not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	defer reader.Close()
+
+	c.DataFromReader(http.StatusOK, size, contentType, reader, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
+
+// DeleteAttachment handles removing an attachment from an expense
+func DeleteAttachment(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	expense, attachment, ok := findAttachment(ctx, c)
+	if !ok {
+		return
+	}
+
+	update := bson.M{
+		"$pull": bson.M{"attachments": bson.M{"_id": attachment.ID}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	if _, err := db.ExpensesCol.UpdateOne(ctx, bson.M{"_id": expense.ID}, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
+		return
+	}
+	deleteAttachmentBlobs(ctx, attachmentKey(expense.ID, attachment.ID), attachment.HasThumbnail)
+	recordEvent(expenseEvent(models.EventExpenseUpdated, expense, nil, bson.M{"change": "attachment_deleted", "file_name": attachment.FileName}))
+
+	c.Status(http.StatusNoContent)
+}
+
+// findAttachment loads the expense and attachment given by :id and
+// :attachment_id. On failure it writes the error response and returns false.
+func findAttachment(ctx context.Context, c *gin.Context) (models.Expense, models.Attachment, bool) {
+	var expense models.Expense
+	expenseID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expense id"})
+		return expense, models.Attachment{}, false
+	}
+	attachmentID, err := primitive.ObjectIDFromHex(c.Param("attachment_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment id"})
+		return expense, models.Attachment{}, false
+	}
+
+	if err := db.ExpensesCol.FindOne(ctx, bson.M{"_id": expenseID}).Decode(&expense); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Expense not found"})
+			return expense, models.Attachment{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch expense"})
+		return expense, models.Attachment{}, false
+	}
+	for _, attachment := range expense.Attachments {
+		if attachment.ID == attachmentID {
+			return expense, attachment, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+	return expense, models.Attachment{}, false
+}
+
+func attachmentKey(expenseID, attachmentID primitive.ObjectID) string {
+	return "expenses/" + expenseID.Hex() + "/" + attachmentID.Hex()
+}
+
+// deleteAttachmentBlobs removes an attachment's contents. Failures only leave
+// an orphaned blob behind, so they are logged rather than returned.
+func deleteAttachmentBlobs(ctx context.Context, key string, thumbnail bool) {
+	keys := []string{key}
+	if thumbnail {
+		keys = append(keys, key+"_thumb")
+	}
+	for _, k := range keys {
+		if err := attachmentStore.Delete(ctx, k); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to delete attachment blob %s: %v", k, err)
+		}
+	}
+}
+
+// attachmentFileName keeps only the base name of a client-supplied file name
+func attachmentFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == "" {
+		return "attachment"
+	}
+	if len(name) > 200 {
+		name = strings.ToValidUTF8(name[:200], "")
+	}
+	return name
+}
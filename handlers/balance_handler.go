@@ -3,90 +3,176 @@ package handlers
 import (
 	"context"
 	"encoding/csv"
+	"errors"
 	"expenses-backend/db"
 	"expenses-backend/models"
-	"fmt"
+	"expenses-backend/utils"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson" // Added bson import
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // BalanceSheetRow represents a row in the balance sheet
 type BalanceSheetRow struct {
-    Name         string  `json:"name"`
-    Email        string  `json:"email"`
-    MobileNumber string  `json:"mobile_number"`
-    TotalSpent   float64 `json:"total_spent"`
-    TotalOwed    float64 `json:"total_owed"`
-    NetBalance   float64 `json:"net_balance"`
+    Name         string                     `json:"name"`
+    Email        string                     `json:"email"`
+    MobileNumber string                     `json:"mobile_number"`
+    Balances     map[string]CurrencyBalance `json:"balances"`
+    Converted    *CurrencyBalance           `json:"converted,omitempty"`
+    // Categories holds the amount spent per category and currency
+    Categories map[string]map[string]float64 `json:"categories"`
+}
+
+// CurrencyBalance holds a user's totals in a single currency
+type CurrencyBalance struct {
+    TotalSpent float64 `json:"total_spent"`
+    TotalOwed  float64 `json:"total_owed"`
+    NetBalance float64 `json:"net_balance"`
 }
 
 // DownloadBalanceSheet generates and sends a CSV balance sheet
 func DownloadBalanceSheet(c *gin.Context) {
+    // Optionally convert every amount into a single currency as well
+    converter, ok := parseConvertTo(c)
+    if !ok {
+        return
+    }
+
     ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
     defer cancel()
 
-    // Fetch all users
-    cursor, err := db.UsersCol.Find(ctx, bson.M{})
+    // Fetch all users, skipping tombstones of merged accounts
+    cursor, err := db.UsersCol.Find(ctx, bson.M{"merged_into": bson.M{"$exists": false}})
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
         return
     }
-    defer cursor.Close(ctx)
+    users := []models.User{}
+    if err := cursor.All(ctx, &users); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse user data"})
+        return
+    }
+
+    // What every user spent and owes comes from one aggregation over the expenses each
+    spentByUser, err := calculateTotalsSpent(ctx, users, converter)
+    if err != nil {
+        c.JSON(balanceErrorStatus(err), gin.H{"error": "Failed to calculate total spent: " + err.Error()})
+        return
+    }
+    owedByUser, err := calculateTotalsOwed(ctx, users, converter)
+    if err != nil {
+        c.JSON(balanceErrorStatus(err), gin.H{"error": "Failed to calculate total owed: " + err.Error()})
+        return
+    }
+    settledByUser, err := calculateTotalsSettled(ctx, users, converter)
+    if err != nil {
+        c.JSON(balanceErrorStatus(err), gin.H{"error": "Failed to calculate settlements: " + err.Error()})
+        return
+    }
 
     balanceRows := []BalanceSheetRow{}
+    currencySet := map[string]bool{}
 
-    for cursor.Next(ctx) {
-        var user models.User
-        if err := cursor.Decode(&user); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse user data"})
-            return
-        }
+    for _, user := range users {
+        spent := spentByUser[user.ID]
+        owed := owedByUser[user.ID]
+        settled := settledByUser[user.ID]
 
-        // Calculate total spent
-        totalSpent, err := calculateTotalSpent(ctx, user.ID)
-        if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate total spent"})
-            return
+        // Amounts in different currencies are never added together
+        balances := map[string]CurrencyBalance{}
+        for currency, amount := range spent.ByCurrency {
+            b := balances[currency]
+            b.TotalSpent = amount
+            balances[currency] = b
         }
-
-        // Calculate total owed
-        totalOwed, err := calculateTotalOwed(ctx, user.ID)
-        if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate total owed"})
-            return
+        for currency, amount := range owed.ByCurrency {
+            b := balances[currency]
+            b.TotalOwed = amount
+            balances[currency] = b
+        }
+        for currency := range settled.ByCurrency {
+            if _, ok := balances[currency]; !ok {
+                balances[currency] = CurrencyBalance{}
+            }
+        }
+        // Paying someone back raises the payer's balance and lowers the payee's, as in userDebts
+        for currency, b := range balances {
+            b.NetBalance = b.TotalSpent - b.TotalOwed + settled.ByCurrency[currency]
+            balances[currency] = b
+            currencySet[currency] = true
         }
 
-        netBalance := totalSpent - totalOwed
-
-        balanceRows = append(balanceRows, BalanceSheetRow{
+        row := BalanceSheetRow{
             Name:         user.Name,
             Email:        user.Email,
             MobileNumber: user.MobileNumber,
-            TotalSpent:   totalSpent,
-            TotalOwed:    totalOwed,
-            NetBalance:   netBalance,
-        })
+            Balances:     balances,
+            Categories:   spent.ByCategory,
+        }
+        if converter != nil {
+            row.Converted = &CurrencyBalance{
+                TotalSpent: spent.Converted,
+                TotalOwed:  owed.Converted,
+                NetBalance: spent.Converted - owed.Converted + settled.Converted,
+            }
+        }
+        balanceRows = append(balanceRows, row)
     }
 
-    // Prepare CSV data
-    csvData := [][]string{
-        {"Name", "Email", "Mobile Number", "Total Spent", "Total Owed", "Net Balance"},
+    currencies := []string{}
+    for currency := range currencySet {
+        currencies = append(currencies, currency)
+    }
+    sort.Strings(currencies)
+    if len(currencies) == 0 {
+        currencies = append(currencies, utils.DefaultCurrency)
     }
 
+    // Prepare CSV data with one column set per currency
+    header := []string{"Name", "Email", "Mobile Number"}
+    for _, currency := range currencies {
+        header = append(header,
+            "Total Spent ("+currency+")",
+            "Total Owed ("+currency+")",
+            "Net Balance ("+currency+")",
+        )
+    }
+    if converter != nil {
+        header = append(header,
+            "Total Spent (in "+converter.target+")",
+            "Total Owed (in "+converter.target+")",
+            "Net Balance (in "+converter.target+")",
+        )
+    }
+    header = append(header, "Spent by Category")
+    csvData := [][]string{header}
+
     for _, r := range balanceRows {
-        csvData = append(csvData, []string{
-            r.Name,
-            r.Email,
-            r.MobileNumber,
-            fmt.Sprintf("%.2f", r.TotalSpent),
-            fmt.Sprintf("%.2f", r.TotalOwed),
-            fmt.Sprintf("%.2f", r.NetBalance),
-        })
+        row := []string{r.Name, r.Email, r.MobileNumber}
+        for _, currency := range currencies {
+            b := r.Balances[currency]
+            row = append(row,
+                utils.FormatAmount(b.TotalSpent, currency),
+                utils.FormatAmount(b.TotalOwed, currency),
+                utils.FormatAmount(b.NetBalance, currency),
+            )
+        }
+        if r.Converted != nil {
+            row = append(row,
+                utils.FormatAmount(r.Converted.TotalSpent, converter.target),
+                utils.FormatAmount(r.Converted.TotalOwed, converter.target),
+                utils.FormatAmount(r.Converted.NetBalance, converter.target),
+            )
+        }
+        row = append(row, formatCategoryTotals(r.Categories))
+        csvData = append(csvData, row)
     }
 
     // Create CSV file in memory
@@ -106,50 +192,326 @@ func DownloadBalanceSheet(c *gin.Context) {
     c.Data(http.StatusOK, "text/csv", []byte(csvString.String()))
 }
 
-func calculateTotalSpent(ctx context.Context, userID primitive.ObjectID) (float64, error) {
-    filter := bson.M{"created_by": userID}
-    cursor, err := db.ExpensesCol.Find(ctx, filter)
+// spentTotals holds what a user paid for, per currency and per category and currency
+type spentTotals struct {
+    ByCurrency map[string]float64
+    ByCategory map[string]map[string]float64
+    Converted  float64
+}
+
+// currencyTotals holds a user's amounts per currency, and their sum converted into one currency
+type currencyTotals struct {
+    ByCurrency map[string]float64
+    Converted  float64
+}
+
+// expenseDayExpr evaluates to an expense's Day as YYYY-MM-DD, so amounts can
+// be converted at the rate effective on the expense's date
+var expenseDayExpr = bson.M{"$dateToString": bson.M{
+    "format": "%Y-%m-%d",
+    "date": bson.M{"$cond": bson.A{
+        bson.M{"$gt": bson.A{"$expense_date", time.Time{}}},
+        "$expense_date",
+        "$created_at",
+    }},
+    "timezone": defaultedField("$timezone", "UTC"),
+}}
+
+// calculateTotalsSpent sums the amounts of expenses created by each of the users
+// in one aggregation grouped by creator, currency and category. With a converter
+// the groups are split by day as well and converted at each day's rate.
+func calculateTotalsSpent(ctx context.Context, users []models.User, converter *currencyConverter) (map[primitive.ObjectID]spentTotals, error) {
+    totals := map[primitive.ObjectID]spentTotals{}
+    for _, user := range users {
+        totals[user.ID] = spentTotals{
+            ByCurrency: map[string]float64{},
+            ByCategory: map[string]map[string]float64{},
+        }
+    }
+
+    id := bson.M{"user": "$created_by", "currency": "$currency", "category": "$category"}
+    if converter != nil {
+        id["day"] = expenseDayExpr
+    }
+    pipeline := mongo.Pipeline{
+        {{Key: "$group", Value: bson.M{"_id": id, "total": bson.M{"$sum": "$amount"}}}},
+    }
+    cursor, err := db.ExpensesCol.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
     if err != nil {
-        return 0, err
+        return nil, err
     }
     defer cursor.Close(ctx)
 
-    totalSpent := 0.0
     for cursor.Next(ctx) {
-        var expense models.Expense
-        if err := cursor.Decode(&expense); err != nil {
-            return 0, err
+        var group struct {
+            ID struct {
+                User     primitive.ObjectID `bson:"user"`
+                Currency string             `bson:"currency"`
+                Category string             `bson:"category"`
+                Day      string             `bson:"day"`
+            } `bson:"_id"`
+            Total float64 `bson:"total"`
+        }
+        if err := cursor.Decode(&group); err != nil {
+            return nil, err
+        }
+        t, ok := totals[group.ID.User]
+        if !ok {
+            continue
         }
-        totalSpent += expense.Amount
+
+        currency := utils.NormalizeCurrency(group.ID.Currency)
+        t.ByCurrency[currency] += group.Total
+
+        category := group.ID.Category
+        if category == "" {
+            category = models.DefaultCategory
+        }
+        if t.ByCategory[category] == nil {
+            t.ByCategory[category] = map[string]float64{}
+        }
+        t.ByCategory[category][currency] += group.Total
+
+        if converter != nil {
+            amount, err := convertOnDay(ctx, converter, group.Total, currency, group.ID.Day)
+            if err != nil {
+                return nil, err
+            }
+            t.Converted += amount
+        }
+        totals[group.ID.User] = t
     }
-    return totalSpent, nil
+    return totals, cursor.Err()
 }
 
-func calculateTotalOwed(ctx context.Context, userID primitive.ObjectID) (float64, error) {
-    filter := bson.M{"participants": userID}
-    cursor, err := db.ExpensesCol.Find(ctx, filter)
+// formatCategoryTotals renders per-category spending as "food: 1500.00 INR; travel: 300.00 INR"
+func formatCategoryTotals(categories map[string]map[string]float64) string {
+    names := []string{}
+    for name := range categories {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    parts := []string{}
+    for _, name := range names {
+        currencies := []string{}
+        for currency := range categories[name] {
+            currencies = append(currencies, currency)
+        }
+        sort.Strings(currencies)
+        for _, currency := range currencies {
+            parts = append(parts, name+": "+utils.FormatAmount(categories[name][currency], currency)+" "+currency)
+        }
+    }
+    return strings.Join(parts, "; ")
+}
+
+// calculateTotalsOwed sums each user's shares of the expenses they participate
+// in, per currency, in one aggregation that unwinds split_details and pairs
+// each share with its participant. With a converter it also totals the shares
+// converted at each expense's date.
+func calculateTotalsOwed(ctx context.Context, users []models.User, converter *currencyConverter) (map[primitive.ObjectID]currencyTotals, error) {
+    totals := map[primitive.ObjectID]currencyTotals{}
+    for _, user := range users {
+        totals[user.ID] = currencyTotals{ByCurrency: map[string]float64{}}
+    }
+
+    id := bson.M{"user": "$user", "currency": "$currency"}
+    if converter != nil {
+        id["day"] = expenseDayExpr
+    }
+    isEmail := func(key string) bson.M {
+        return bson.M{"$ne": bson.A{bson.M{"$indexOfBytes": bson.A{key, "@"}}, -1}}
+    }
+    pipeline := mongo.Pipeline{
+        {{Key: "$project", Value: bson.M{
+            "participants": 1,
+            "currency":     1,
+            "expense_date": 1,
+            "created_at":   1,
+            "timezone":     1,
+            "share":        bson.M{"$ifNull": bson.A{bson.M{"$objectToArray": "$split_details"}, bson.A{}}},
+        }}},
+        // Older expenses key shares by email; only those look up their participants' users
+        {{Key: "$addFields", Value: bson.M{"email_keyed": bson.M{"$cond": bson.A{
+            bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{"input": "$share", "as": "s", "in": isEmail("$$s.k")}}}},
+            "$participants",
+            bson.A{},
+        }}}}},
+        {{Key: "$lookup", Value: bson.M{
+            "from":         db.UsersCol.Name(),
+            "localField":   "email_keyed",
+            "foreignField": "_id",
+            "as":           "people",
+        }}},
+        {{Key: "$unwind", Value: "$share"}},
+        {{Key: "$match", Value: bson.M{"share.v": bson.M{"$type": "number"}}}},
+        {{Key: "$addFields", Value: bson.M{"key": bson.M{"$toLower": "$share.k"}}}},
+        // Pair each share with the participant it is keyed by: their id, or one
+        // of their current or previous emails. Shares matching nobody are dropped.
+        {{Key: "$addFields", Value: bson.M{"user": bson.M{"$cond": bson.A{
+            isEmail("$key"),
+            bson.M{"$arrayElemAt": bson.A{bson.M{"$map": bson.M{
+                "input": bson.M{"$filter": bson.M{
+                    "input": "$people",
+                    "as":    "p",
+                    "cond": bson.M{"$in": bson.A{"$key", bson.M{"$map": bson.M{
+                        "input": bson.M{"$concatArrays": bson.A{
+                            bson.A{"$$p.email"},
+                            bson.M{"$ifNull": bson.A{"$$p.previous_emails.value", bson.A{}}},
+                        }},
+                        "as": "e",
+                        "in": bson.M{"$toLower": "$$e"},
+                    }}}},
+                }},
+                "as": "p",
+                "in": "$$p._id",
+            }}, 0}},
+            bson.M{"$arrayElemAt": bson.A{bson.M{"$filter": bson.M{
+                "input": "$participants",
+                "as":    "p",
+                "cond":  bson.M{"$eq": bson.A{bson.M{"$toString": "$$p"}, "$key"}},
+            }}, 0}},
+        }}}}},
+        {{Key: "$match", Value: bson.M{"user": bson.M{"$exists": true}}}},
+        {{Key: "$group", Value: bson.M{"_id": id, "total": bson.M{"$sum": "$share.v"}}}},
+    }
+    cursor, err := db.ExpensesCol.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
     if err != nil {
-        return 0, err
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    for cursor.Next(ctx) {
+        var group struct {
+            ID struct {
+                User     primitive.ObjectID `bson:"user"`
+                Currency string             `bson:"currency"`
+                Day      string             `bson:"day"`
+            } `bson:"_id"`
+            Total float64 `bson:"total"`
+        }
+        if err := cursor.Decode(&group); err != nil {
+            return nil, err
+        }
+        t, ok := totals[group.ID.User]
+        if !ok {
+            continue
+        }
+
+        currency := utils.NormalizeCurrency(group.ID.Currency)
+        t.ByCurrency[currency] += group.Total
+        if converter != nil {
+            amount, err := convertOnDay(ctx, converter, group.Total, currency, group.ID.Day)
+            if err != nil {
+                return nil, err
+            }
+            t.Converted += amount
+        }
+        totals[group.ID.User] = t
+    }
+    return totals, cursor.Err()
+}
+
+// calculateTotalsSettled sums what each user paid back less what they were
+// paid back, per currency, in one aggregation over settlements. With a
+// converter the sums are converted at the rate on the settlement's day.
+func calculateTotalsSettled(ctx context.Context, users []models.User, converter *currencyConverter) (map[primitive.ObjectID]currencyTotals, error) {
+    totals := map[primitive.ObjectID]currencyTotals{}
+    for _, user := range users {
+        totals[user.ID] = currencyTotals{ByCurrency: map[string]float64{}}
+    }
+
+    id := bson.M{"user": "$entries.user", "currency": "$currency"}
+    if converter != nil {
+        id["day"] = bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$created_at"}}
+    }
+    pipeline := mongo.Pipeline{
+        // Settlements left between two merged accounts cancel out
+        {{Key: "$match", Value: bson.M{"$expr": bson.M{"$ne": bson.A{"$payer", "$payee"}}}}},
+        {{Key: "$project", Value: bson.M{
+            "currency":   1,
+            "created_at": 1,
+            "entries": bson.A{
+                bson.M{"user": "$payer", "amount": "$amount"},
+                bson.M{"user": "$payee", "amount": bson.M{"$multiply": bson.A{"$amount", -1}}},
+            },
+        }}},
+        {{Key: "$unwind", Value: "$entries"}},
+        {{Key: "$group", Value: bson.M{"_id": id, "total": bson.M{"$sum": "$entries.amount"}}}},
+    }
+    cursor, err := db.SettlementsCol.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, err
     }
     defer cursor.Close(ctx)
 
-    totalOwed := 0.0
     for cursor.Next(ctx) {
-        var expense models.Expense
-        if err := cursor.Decode(&expense); err != nil {
-            return 0, err
-        }
-
-        // Find the amount owed by the user in split_details
-        for key, amount := range expense.SplitDetails {
-            if strings.EqualFold(key, userID.Hex()) || strings.EqualFold(key, userID.String()) {
-                amt, ok := convertToFloat64(amount)
-                if ok {
-                    totalOwed += amt
-                }
-                break
+        var group struct {
+            ID struct {
+                User     primitive.ObjectID `bson:"user"`
+                Currency string             `bson:"currency"`
+                Day      string             `bson:"day"`
+            } `bson:"_id"`
+            Total float64 `bson:"total"`
+        }
+        if err := cursor.Decode(&group); err != nil {
+            return nil, err
+        }
+        t, ok := totals[group.ID.User]
+        if !ok {
+            continue
+        }
+
+        currency := utils.NormalizeCurrency(group.ID.Currency)
+        t.ByCurrency[currency] += group.Total
+        if converter != nil {
+            amount, err := convertOnDay(ctx, converter, group.Total, currency, group.ID.Day)
+            if err != nil {
+                return nil, err
+            }
+            t.Converted += amount
+        }
+        totals[group.ID.User] = t
+    }
+    return totals, cursor.Err()
+}
+
+// convertOnDay converts an amount at the rate effective on a YYYY-MM-DD day
+func convertOnDay(ctx context.Context, converter *currencyConverter, amount float64, currency, day string) (float64, error) {
+    date, err := time.Parse("2006-01-02", day)
+    if err != nil {
+        return 0, err
+    }
+    return converter.Convert(ctx, amount, currency, date)
+}
+
+// balanceErrorStatus maps a missing exchange rate to a client error and anything else to a server error
+func balanceErrorStatus(err error) int {
+    if errors.Is(err, errNoExchangeRate) {
+        return http.StatusBadRequest
+    }
+    return http.StatusInternalServerError
+}
+
+// userSplitKeys returns the split_details keys that may refer to the user. Older
+// expenses keyed split_details by email, possibly one the user has since replaced.
+func userSplitKeys(user models.User) []string {
+    keys := []string{user.ID.Hex(), user.Email}
+    for _, prev := range user.PreviousEmails {
+        keys = append(keys, prev.Value)
+    }
+    return keys
+}
+
+// splitAmountFor returns the split_details amount stored under any of the given keys
+func splitAmountFor(splitDetails map[string]interface{}, keys []string) (float64, bool) {
+    for key, amount := range splitDetails {
+        for _, k := range keys {
+            if k != "" && strings.EqualFold(key, k) {
+                return convertToFloat64(amount)
             }
         }
     }
-    return totalOwed, nil
+    return 0, false
 }
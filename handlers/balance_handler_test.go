@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// useBalanceTestDB points the users and expenses collections at a scratch
+// database on MONGO_URI for the rest of the test, skipping without one
+func useBalanceTestDB(tb testing.TB) {
+	tb.Helper()
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		tb.Skip("MONGO_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		tb.Fatalf("connect: %v", err)
+	}
+	database := client.Database(fmt.Sprintf("expenses_test_%d", time.Now().UnixNano()))
+
+	users, expenses := db.UsersCol, db.ExpensesCol
+	db.UsersCol, db.ExpensesCol = database.Collection("users"), database.Collection("expenses")
+	tb.Cleanup(func() {
+		db.UsersCol, db.ExpensesCol = users, expenses
+		database.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+}
+
+// seedBalanceData inserts users and expenses split between 2 to 5 of them. Every
+// tenth expense keys its shares by email, as expenses did before user IDs,
+// sometimes by a replaced email or in another case.
+func seedBalanceData(tb testing.TB, userCount, expenseCount int) []models.User {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	rng := rand.New(rand.NewSource(1))
+	now := time.Now()
+	users := make([]models.User, userCount)
+	docs := make([]interface{}, userCount)
+	for i := range users {
+		users[i] = models.User{
+			ID:           primitive.NewObjectID(),
+			Name:         fmt.Sprintf("User %d", i),
+			Email:        fmt.Sprintf("user%d@example.com", i),
+			MobileNumber: fmt.Sprint(7000000000 + i),
+			CreatedAt:    now,
+		}
+		if i%3 == 0 {
+			users[i].PreviousEmails = []models.PreviousIdentifier{{Value: fmt.Sprintf("old%d@example.com", i), ReplacedAt: now}}
+		}
+		docs[i] = users[i]
+	}
+	if _, err := db.UsersCol.InsertMany(ctx, docs); err != nil {
+		tb.Fatalf("seed users: %v", err)
+	}
+
+	currencies := []string{"INR", "INR", "USD"}
+	batch := []interface{}{}
+	for i := 0; i < expenseCount; i++ {
+		size := 2 + rng.Intn(4)
+		participants := []primitive.ObjectID{}
+		splitDetails := map[string]interface{}{}
+		for _, j := range rng.Perm(userCount)[:size] {
+			user := users[j]
+			participants = append(participants, user.ID)
+			key := user.ID.Hex()
+			if i%10 == 0 {
+				key = user.Email
+				if len(user.PreviousEmails) > 0 && i%20 == 0 {
+					key = strings.ToUpper(user.PreviousEmails[0].Value)
+				}
+			}
+			splitDetails[key] = float64(rng.Intn(100000)) / 100
+		}
+		batch = append(batch, models.Expense{
+			Description:  fmt.Sprintf("Expense %d", i),
+			Amount:       100,
+			Currency:     currencies[i%len(currencies)],
+			CreatedBy:    participants[0],
+			SplitType:    "Exact",
+			Participants: participants,
+			SplitDetails: splitDetails,
+			ExpenseDate:  now,
+			CreatedAt:    now,
+		})
+		if len(batch) == 1000 || i == expenseCount-1 {
+			if _, err := db.ExpensesCol.InsertMany(ctx, batch); err != nil {
+				tb.Fatalf("seed expenses: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	return users
+}
+
+func TestCalculateTotalsOwed(t *testing.T) {
+	useBalanceTestDB(t)
+	users := seedBalanceData(t, 20, 500)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Work the totals out in Go from each expense's shares
+	cursor, err := db.ExpensesCol.Find(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expenses := []models.Expense{}
+	if err := cursor.All(ctx, &expenses); err != nil {
+		t.Fatal(err)
+	}
+	want := map[primitive.ObjectID]map[string]float64{}
+	for _, user := range users {
+		want[user.ID] = map[string]float64{}
+		for _, expense := range expenses {
+			if share, ok := splitAmountFor(expense.SplitDetails, userSplitKeys(user)); ok {
+				want[user.ID][expense.Currency] += share
+			}
+		}
+	}
+
+	got, err := calculateTotalsOwed(ctx, users, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		for _, currency := range []string{"INR", "USD"} {
+			if math.Abs(got[user.ID].ByCurrency[currency]-want[user.ID][currency]) > 1e-6 {
+				t.Errorf("%s owes %v %s, want %v", user.Email, got[user.ID].ByCurrency[currency], currency, want[user.ID][currency])
+			}
+		}
+	}
+}
+
+// BenchmarkCalculateTotalsOwed times the owed aggregation of the balance sheet.
+// Run it against a local MongoDB, e.g.
+//
+//	MONGO_URI=mongodb://localhost:27017 go test ./handlers -run '^$' -bench TotalsOwed
+func BenchmarkCalculateTotalsOwed(b *testing.B) {
+	useBalanceTestDB(b)
+	users := seedBalanceData(b, 2000, 50000)
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := calculateTotalsOwed(ctx, users, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
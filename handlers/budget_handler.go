@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/utils"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// budgetAlertHistory is how many alerted thresholds are remembered per budget
+const budgetAlertHistory = 24
+
+// BudgetInput is the body of creating a budget
+type BudgetInput struct {
+	User   string  `json:"user" binding:"required"`
+	Amount float64 `json:"amount" binding:"required,gt=0"`
+	// Category limits the budget to one category; empty covers every category
+	Category string `json:"category,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// BudgetUpdateInput holds the budget fields that can be changed; omitted fields are left as is
+type BudgetUpdateInput struct {
+	Amount   *float64 `json:"amount,omitempty"`
+	Timezone *string  `json:"timezone,omitempty"`
+}
+
+// BudgetStatus is how much of a budget has been spent in one month
+type BudgetStatus struct {
+	Budget            models.Budget `json:"budget"`
+	Month             string        `json:"month"`
+	PeriodStart       time.Time     `json:"period_start"`
+	PeriodEnd         time.Time     `json:"period_end"`
+	Spent             float64       `json:"spent"`
+	Remaining         float64       `json:"remaining"`
+	Percent           float64       `json:"percent"`
+	ExpenseCount      int           `json:"expense_count"`
+	ThresholdsCrossed []int         `json:"thresholds_crossed"`
+}
+
+// CreateBudget handles setting a monthly budget for a user
+func CreateBudget(c *gin.Context) {
+	var input BudgetInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency := utils.NormalizeCurrency(input.Currency)
+	if _, ok := utils.MinorUnits(currency); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency '" + currency + "'"})
+		return
+	}
+	if !utils.HasValidPrecision(input.Amount, currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount has more decimal places than " + currency + " allows"})
+		return
+	}
+	timezone := strings.TrimSpace(input.Timezone)
+	if _, err := time.LoadLocation(timezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone '" + timezone + "'"})
+		return
+	}
+
+	user, err := identifyUser(input.User)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid 'user' identifier: ", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	category := ""
+	if strings.TrimSpace(input.Category) != "" {
+		category, err = resolveCategory(ctx, input.Category, user.ID)
+		if err != nil {
+			if errors.Is(err, errUnknownCategory) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category: " + err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve category"})
+			return
+		}
+	}
+
+	now := time.Now()
+	budget := models.Budget{
+		User:      user.ID,
+		Category:  category,
+		Amount:    input.Amount,
+		Currency:  currency,
+		Timezone:  timezone,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	result, err := db.BudgetsCol.InsertOne(ctx, budget)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The user already has a " + currency + " budget for this category"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create budget"})
+		return
+	}
+	budget.ID = result.InsertedID.(primitive.ObjectID)
+
+	c.JSON(http.StatusCreated, budget)
+}
+
+// GetBudgets handles listing the budgets of the user given by the 'identifier' query parameter
+func GetBudgets(c *gin.Context) {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identifier (email, mobile_number, or name) is required"})
+		return
+	}
+
+	user, err := identifyUser(identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "currency", Value: 1}, {Key: "category", Value: 1}})
+	cursor, err := db.BudgetsCol.Find(ctx, bson.M{"user": user.ID}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve budgets"})
+		return
+	}
+	budgets := []models.Budget{}
+	if err := cursor.All(ctx, &budgets); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve budgets"})
+		return
+	}
+
+	c.JSON(http.StatusOK, budgets)
+}
+
+// GetBudgetStatus handles showing how much of a budget is spent this month, or
+// in the month given by the 'month' query parameter (YYYY-MM)
+func GetBudgetStatus(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	budget, ok := findBudget(ctx, c)
+	if !ok {
+		return
+	}
+
+	at := time.Now()
+	if month := c.Query("month"); month != "" {
+		parsed, err := time.ParseInLocation("2006-01", month, budgetLocation(budget))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "month must be formatted as YYYY-MM"})
+			return
+		}
+		at = parsed
+	}
+
+	status, err := budgetStatus(ctx, budget, at)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate budget status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// UpdateBudget handles changing a budget's amount or timezone
+func UpdateBudget(c *gin.Context) {
+	var input BudgetUpdateInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	budget, ok := findBudget(ctx, c)
+	if !ok {
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	if input.Amount != nil {
+		if *input.Amount <= 0 || !utils.HasValidPrecision(*input.Amount, budget.Currency) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+			return
+		}
+		set["amount"] = *input.Amount
+	}
+	if input.Timezone != nil {
+		timezone := strings.TrimSpace(*input.Timezone)
+		if _, err := time.LoadLocation(timezone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone '" + timezone + "'"})
+			return
+		}
+		set["timezone"] = timezone
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := db.BudgetsCol.FindOneAndUpdate(ctx, bson.M{"_id": budget.ID}, bson.M{"$set": set}, opts).Decode(&budget); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update budget"})
+		return
+	}
+
+	c.JSON(http.StatusOK, budget)
+}
+
+// DeleteBudget handles removing a budget
+func DeleteBudget(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid budget id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.BudgetsCol.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete budget"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// findBudget loads the budget given by :id. On failure it writes the error
+// response and returns false.
+func findBudget(ctx context.Context, c *gin.Context) (models.Budget, bool) {
+	var budget models.Budget
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid budget id"})
+		return budget, false
+	}
+	if err := db.BudgetsCol.FindOne(ctx, bson.M{"_id": id}).Decode(&budget); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+			return budget, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch budget"})
+		return budget, false
+	}
+	return budget, true
+}
+
+// budgetStatus computes how much of the budget is spent in the month containing at
+func budgetStatus(ctx context.Context, budget models.Budget, at time.Time) (BudgetStatus, error) {
+	start, end := budgetPeriod(budget, at)
+	status := BudgetStatus{
+		Budget:            budget,
+		Month:             start.Format("2006-01"),
+		PeriodStart:       start,
+		PeriodEnd:         end,
+		ThresholdsCrossed: []int{},
+	}
+
+	keys, err := splitKeysByUser(ctx, []primitive.ObjectID{budget.User})
+	if err != nil {
+		return status, err
+	}
+	spent, count, err := budgetSpent(ctx, budget, keys[budget.User], start, end)
+	if err != nil {
+		return status, err
+	}
+
+	status.Spent = utils.RoundAmount(spent, budget.Currency)
+	status.Remaining = utils.RoundAmount(budget.Amount-spent, budget.Currency)
+	// Thresholds compare the exact percentage; 99.96% must not count as 100%
+	percent := spent / budget.Amount * 100
+	status.Percent = math.Round(percent*10) / 10
+	status.ExpenseCount = count
+	for _, threshold := range models.BudgetThresholds {
+		if percent >= float64(threshold) {
+			status.ThresholdsCrossed = append(status.ThresholdsCrossed, threshold)
+		}
+	}
+	return status, nil
+}
+
+// budgetSpent sums the user's shares of the expenses dated within [start, end)
+// that the budget covers, in a single aggregation over expenses. keys are the
+// user's split_details keys.
+func budgetSpent(ctx context.Context, budget models.Budget, keys []string, start, end time.Time) (float64, int, error) {
+	match := bson.M{
+		"participants": budget.User,
+		"expense_date": bson.M{"$gte": start, "$lt": end},
+		"currency":     budget.Currency,
+	}
+	if budget.Currency == utils.DefaultCurrency {
+		// Expenses recorded before currencies were supported are in the default currency
+		match["currency"] = bson.M{"$in": []interface{}{budget.Currency, "", nil}}
+	}
+	if budget.Category != "" {
+		match["category"] = categoryFilter(budget.Category)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$project", Value: bson.M{"share": bson.M{"$objectToArray": "$split_details"}}}},
+		{{Key: "$unwind", Value: "$share"}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$in": bson.A{bson.M{"$toLower": "$share.k"}, lowerKeys(keys)}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      nil,
+			"spent":    bson.M{"$sum": bson.M{"$toDouble": "$share.v"}},
+			"expenses": bson.M{"$sum": 1},
+		}}},
+	}
+	cursor, err := db.ExpensesCol.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, 0, err
+	}
+	var results []struct {
+		Spent    float64 `bson:"spent"`
+		Expenses int     `bson:"expenses"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return 0, 0, err
+	}
+	if len(results) == 0 {
+		return 0, 0, nil
+	}
+	return results[0].Spent, results[0].Expenses, nil
+}
+
+// budgetPeriod returns the start and end of the month containing at, in the budget's timezone
+func budgetPeriod(budget models.Budget, at time.Time) (time.Time, time.Time) {
+	at = at.In(budgetLocation(budget))
+	start := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, at.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+func budgetLocation(budget models.Budget) *time.Location {
+	if loc, err := time.LoadLocation(budget.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// evaluateBudgets checks the budgets of a new expense's participants and
+// records an event for the owner when the expense takes one past a threshold.
+// Each threshold is alerted once per budget and month.
+func evaluateBudgets(expense models.Expense) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	category := expense.Category
+	if category == "" {
+		category = models.DefaultCategory
+	}
+	filter := bson.M{
+		"user":     bson.M{"$in": expense.Participants},
+		"currency": utils.NormalizeCurrency(expense.Currency),
+		"$or": []bson.M{
+			{"category": bson.M{"$exists": false}},
+			{"category": category},
+		},
+	}
+	cursor, err := db.BudgetsCol.Find(ctx, filter)
+	if err != nil {
+		log.Printf("Failed to fetch budgets for expense %s: %v", expense.ID.Hex(), err)
+		return
+	}
+	budgets := []models.Budget{}
+	if err := cursor.All(ctx, &budgets); err != nil {
+		log.Printf("Failed to fetch budgets for expense %s: %v", expense.ID.Hex(), err)
+		return
+	}
+
+	for _, budget := range budgets {
+		status, err := budgetStatus(ctx, budget, expense.Date())
+		if err != nil {
+			log.Printf("Failed to evaluate budget %s: %v", budget.ID.Hex(), err)
+			continue
+		}
+
+		// Mark every crossed threshold, but only alert the highest newly crossed one
+		alert := 0
+		for i := len(status.ThresholdsCrossed) - 1; i >= 0; i-- {
+			threshold := status.ThresholdsCrossed[i]
+			key := status.Month + ":" + strconv.Itoa(threshold)
+			result, err := db.BudgetsCol.UpdateOne(ctx, bson.M{"_id": budget.ID, "alerts": bson.M{"$ne": key}}, bson.M{
+				"$push": bson.M{"alerts": bson.M{"$each": []string{key}, "$slice": -budgetAlertHistory}},
+			})
+			if err != nil {
+				log.Printf("Failed to record alert of budget %s: %v", budget.ID.Hex(), err)
+				break
+			}
+			if result.ModifiedCount > 0 && alert == 0 {
+				alert = threshold
+			}
+		}
+		if alert == 0 {
+			continue
+		}
+
+		data := bson.M{
+			"budget_id": budget.ID,
+			"month":     status.Month,
+			"threshold": alert,
+			"spent":     status.Spent,
+			"limit":     budget.Amount,
+			"percent":   status.Percent,
+			"currency":  budget.Currency,
+		}
+		if budget.Category != "" {
+			data["category"] = budget.Category
+		}
+		expenseID := expense.ID
+		recordEvent(models.Event{
+			Type:      models.EventBudgetThreshold,
+			Actor:     &expense.CreatedBy,
+			Users:     []primitive.ObjectID{budget.User},
+			ExpenseID: &expenseID,
+			Data:      data,
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type CategoryInput struct {
+	Name      string `json:"name" binding:"required,max=50"`
+	CreatedBy string `json:"created_by" binding:"required"`
+}
+
+// errUnknownCategory is returned when a category is neither built in nor owned by the user
+var errUnknownCategory = errors.New("unknown category")
+
+// CreateCategory handles creating a custom category for a user
+func CreateCategory(c *gin.Context) {
+	var input CategoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := normalizeCategory(input.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Category name is required"})
+		return
+	}
+	if isBuiltinCategory(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Category '" + name + "' is built in"})
+		return
+	}
+
+	creator, err := identifyUser(input.CreatedBy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid 'created_by' identifier: ", err))
+		return
+	}
+
+	category := models.Category{
+		Name:      name,
+		CreatedBy: creator.ID,
+		CreatedAt: time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.CategoriesCol.InsertOne(ctx, category)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Category already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create category"})
+		return
+	}
+
+	category.ID = result.InsertedID.(primitive.ObjectID)
+	category.Custom = true
+
+	c.JSON(http.StatusCreated, category)
+}
+
+// GetCategories handles listing the built-in categories plus the custom
+// categories of the user given by the optional 'identifier' query parameter
+func GetCategories(c *gin.Context) {
+	categories := []models.Category{}
+	for _, name := range models.BuiltinCategories {
+		categories = append(categories, models.Category{Name: name})
+	}
+
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusOK, categories)
+		return
+	}
+
+	user, err := identifyUser(identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.CategoriesCol.Find(ctx, bson.M{"created_by": user.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve categories"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var category models.Category
+		if err := cursor.Decode(&category); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse categories"})
+			return
+		}
+		category.Custom = true
+		categories = append(categories, category)
+	}
+
+	c.JSON(http.StatusOK, categories)
+}
+
+// resolveCategory normalizes a category name and checks that it is built in or
+// a custom category of the given user
+func resolveCategory(ctx context.Context, name string, userID primitive.ObjectID) (string, error) {
+	name = normalizeCategory(name)
+	if isBuiltinCategory(name) {
+		return name, nil
+	}
+
+	err := db.CategoriesCol.FindOne(ctx, bson.M{"name": name, "created_by": userID}).Err()
+	if err == mongo.ErrNoDocuments {
+		return "", fmt.Errorf("%w '%s'", errUnknownCategory, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// categoryFilter matches expenses in category, treating expenses stored
+// without a category as DefaultCategory
+func categoryFilter(category string) interface{} {
+	if category == models.DefaultCategory {
+		return bson.M{"$in": []interface{}{category, "", nil}}
+	}
+	return category
+}
+
+// normalizeCategory lower-cases a category name and collapses inner whitespace
+func normalizeCategory(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+func isBuiltinCategory(name string) bool {
+	for _, builtin := range models.BuiltinCategories {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+type ExpenseCategoryInput struct {
+	Category string `json:"category" binding:"required"`
+}
+
+// SetExpenseCategory handles confirming or correcting an expense's category.
+// The category is then treated as chosen by the user for future suggestions.
+func SetExpenseCategory(c *gin.Context) {
+	expenseID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expense id"})
+		return
+	}
+
+	var input ExpenseCategoryInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var expense models.Expense
+	if err := db.ExpensesCol.FindOne(ctx, bson.M{"_id": expenseID}).Decode(&expense); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Expense not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch expense"})
+		return
+	}
+
+	category, err := resolveCategory(ctx, input.Category, expense.CreatedBy)
+	if err != nil {
+		if errors.Is(err, errUnknownCategory) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve category"})
+		return
+	}
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"category": category, "category_source": CategorySourceUser, "updated_at": now}}
+	if _, err := db.ExpensesCol.UpdateOne(ctx, bson.M{"_id": expenseID}, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update expense"})
+		return
+	}
+
+	expense.Category = category
+	expense.CategorySource = CategorySourceUser
+	expense.UpdatedAt = now
+	recordEvent(expenseEvent(models.EventExpenseUpdated, expense, nil, bson.M{"change": "category", "category": category}))
+	c.JSON(http.StatusOK, expense)
+}
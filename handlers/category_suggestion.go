@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"math"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Sources of an expense's category
+const (
+	CategorySourceUser      = "user"
+	CategorySourceSuggested = "suggested"
+	CategorySourceDefault   = "default"
+)
+
+const (
+	// suggestionHistorySize is how many of the user's past categorized expenses are compared
+	suggestionHistorySize = 200
+	// minSuggestionConfidence is the confidence below which the default category is used
+	minSuggestionConfidence = 0.5
+)
+
+// CategorySuggestion is the category picked for an expense created without one
+type CategorySuggestion struct {
+	Category   string  `json:"category"`
+	Confidence float64 `json:"confidence"`
+	// Source is "history" when learned from the user's past expenses, "keywords"
+	// when matched by the built-in rules and "default" when nothing matched
+	Source string `json:"source"`
+}
+
+// categoryKeywords maps description words to built-in categories
+var categoryKeywords = map[string][]string{
+	"food": {"swiggy", "zomato", "dinner", "lunch", "breakfast", "restaurant", "cafe", "coffee",
+		"pizza", "burger", "biryani", "snacks", "dominos", "starbucks", "food", "meal", "drinks"},
+	"groceries": {"grocery", "groceries", "bigbasket", "blinkit", "zepto", "dmart", "vegetables",
+		"fruits", "milk", "supermarket", "kirana"},
+	"travel": {"flight", "flights", "hotel", "airbnb", "trip", "train", "irctc", "visa",
+		"holiday", "resort", "makemytrip", "goibibo", "hostel"},
+	"transport": {"uber", "ola", "rapido", "taxi", "cab", "auto", "metro", "bus", "fuel", "petrol",
+		"diesel", "parking", "toll", "fastag", "airport"},
+	"rent":          {"rent", "lease", "deposit"},
+	"utilities":     {"electricity", "wifi", "internet", "broadband", "water", "gas", "recharge", "dth", "bill", "bills"},
+	"entertainment": {"movie", "movies", "netflix", "spotify", "prime", "hotstar", "concert", "pvr", "inox", "bookmyshow", "party", "games"},
+	"shopping":      {"amazon", "flipkart", "myntra", "ajio", "clothes", "shoes", "shopping", "mall"},
+	"health":        {"pharmacy", "medicine", "medicines", "doctor", "hospital", "apollo", "clinic", "gym", "dentist"},
+	"education":     {"course", "books", "tuition", "fees", "udemy", "coursera", "exam", "school", "college"},
+	"household":     {"maid", "cook", "cleaning", "repair", "furniture", "plumber", "electrician", "laundry", "ikea"},
+	"gifts":         {"gift", "gifts", "birthday", "anniversary", "wedding"},
+}
+
+// categoryStopWords are ignored when comparing descriptions
+var categoryStopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "to": true, "at": true, "for": true, "from": true,
+	"of": true, "in": true, "on": true, "and": true, "with": true, "my": true, "our": true,
+}
+
+// suggestCategory picks a category for a description, preferring what the
+// user chose for similar past expenses over the built-in keyword rules
+func suggestCategory(ctx context.Context, description string, userID primitive.ObjectID) (CategorySuggestion, error) {
+	tokens := descriptionTokens(description)
+
+	fromHistory, err := suggestFromHistory(ctx, tokens, userID)
+	if err != nil {
+		return CategorySuggestion{}, err
+	}
+	fromKeywords := suggestFromKeywords(tokens)
+
+	best := fromKeywords
+	if fromHistory.Confidence >= fromKeywords.Confidence {
+		best = fromHistory
+	}
+	if best.Confidence < minSuggestionConfidence {
+		return CategorySuggestion{Category: models.DefaultCategory, Confidence: 0, Source: "default"}, nil
+	}
+	return best, nil
+}
+
+// suggestFromHistory votes for categories of the user's past expenses weighted by
+// how similar their descriptions are, counting only categories the user chose
+func suggestFromHistory(ctx context.Context, tokens map[string]bool, userID primitive.ObjectID) (CategorySuggestion, error) {
+	if len(tokens) == 0 {
+		return CategorySuggestion{}, nil
+	}
+
+	filter := bson.M{"created_by": userID, "category_source": CategorySourceUser}
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetLimit(suggestionHistorySize).
+		SetProjection(bson.M{"description": 1, "category": 1})
+
+	cursor, err := db.ExpensesCol.Find(ctx, filter, findOptions)
+	if err != nil {
+		return CategorySuggestion{}, err
+	}
+	defer cursor.Close(ctx)
+
+	votes := map[string]float64{}
+	bestSimilarity := map[string]float64{}
+	total := 0.0
+	for cursor.Next(ctx) {
+		var expense models.Expense
+		if err := cursor.Decode(&expense); err != nil {
+			return CategorySuggestion{}, err
+		}
+		similarity := jaccard(tokens, descriptionTokens(expense.Description))
+		if similarity == 0 {
+			continue
+		}
+		votes[expense.Category] += similarity
+		total += similarity
+		bestSimilarity[expense.Category] = math.Max(bestSimilarity[expense.Category], similarity)
+	}
+
+	category, vote := topCategory(votes)
+	if category == "" {
+		return CategorySuggestion{}, nil
+	}
+
+	// Agreement between past expenses times how close the closest one was
+	confidence := (vote / total) * (0.5 + 0.5*bestSimilarity[category])
+	return CategorySuggestion{Category: category, Confidence: roundConfidence(confidence), Source: "history"}, nil
+}
+
+// suggestFromKeywords matches description words against categoryKeywords
+func suggestFromKeywords(tokens map[string]bool) CategorySuggestion {
+	hits := map[string]float64{}
+	total := 0.0
+	for category, keywords := range categoryKeywords {
+		for _, keyword := range keywords {
+			if tokens[keyword] {
+				hits[category]++
+				total++
+			}
+		}
+	}
+
+	category, count := topCategory(hits)
+	if category == "" {
+		return CategorySuggestion{}
+	}
+
+	// One keyword gives 0.6, each further one adds up to 0.9, scaled down when other categories also matched
+	confidence := math.Min(0.6+0.15*(count-1), 0.9) * (count / total)
+	return CategorySuggestion{Category: category, Confidence: roundConfidence(confidence), Source: "keywords"}
+}
+
+// topCategory returns the highest-scoring category, breaking ties alphabetically
+func topCategory(scores map[string]float64) (string, float64) {
+	best, bestScore := "", 0.0
+	for category, score := range scores {
+		if score > bestScore || (score == bestScore && score > 0 && category < best) {
+			best, bestScore = category, score
+		}
+	}
+	return best, bestScore
+}
+
+// descriptionTokens splits a description into lower-case words without stop words
+func descriptionTokens(description string) map[string]bool {
+	tokens := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if len(w) > 1 && !categoryStopWords[w] {
+			tokens[w] = true
+		}
+	}
+	return tokens
+}
+
+// jaccard returns the share of words two descriptions have in common
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for w := range a {
+		if b[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+func roundConfidence(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxCommentLength = 2000
+	// commentExcerptLength is how many characters of a comment its events carry
+	commentExcerptLength = 80
+)
+
+// CommentInput is the body of creating or editing a comment. Author identifies
+// the commenter by email, mobile number or name.
+type CommentInput struct {
+	Author string `json:"author" binding:"required"`
+	Text   string `json:"text" binding:"required"`
+}
+
+// CommentView is a comment with its author's current name
+type CommentView struct {
+	models.Comment
+	AuthorName string `json:"author_name"`
+}
+
+// AddComment handles posting a comment on an expense
+func AddComment(c *gin.Context) {
+	var input CommentInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	text, err := normalizeCommentText(input.Text)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	expense, author, ok := commentAccess(ctx, c, input.Author)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	comment := models.Comment{
+		ExpenseID: expense.ID,
+		Author:    author.ID,
+		Text:      text,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	result, err := db.CommentsCol.InsertOne(ctx, comment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add comment"})
+		return
+	}
+	comment.ID = result.InsertedID.(primitive.ObjectID)
+
+	// Keep a count on the expense so listings don't have to count comments
+	if _, err := db.ExpensesCol.UpdateOne(ctx, bson.M{"_id": expense.ID}, bson.M{"$inc": bson.M{"comment_count": 1}}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment count"})
+		return
+	}
+
+	recordEvent(commentEvent(models.EventCommentCreated, expense, comment))
+	c.JSON(http.StatusCreated, CommentView{Comment: comment, AuthorName: author.Name})
+}
+
+// GetComments handles listing the comments of an expense, oldest first, to the
+// participant given by the 'identifier' query parameter
+func GetComments(c *gin.Context) {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identifier (email, mobile_number, or name) is required"})
+		return
+	}
+
+	params, err := parsePageParams(c, maxPageLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	expense, _, ok := commentAccess(ctx, c, identifier)
+	if !ok {
+		return
+	}
+
+	sort := bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}
+	page, err := findPage(ctx, db.CommentsCol, bson.M{"expense_id": expense.ID}, sort, params, func(cm models.Comment) bson.D {
+		return bson.D{{Key: "created_at", Value: cm.CreatedAt}, {Key: "_id", Value: cm.ID}}
+	})
+	if err != nil {
+		if errors.Is(err, errCursorSortMismatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve comments"})
+		return
+	}
+
+	names, err := userNames(ctx, page.Data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve comment authors"})
+		return
+	}
+	result := Page[CommentView]{
+		Data:       make([]CommentView, 0, len(page.Data)),
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+		Total:      page.Total,
+	}
+	for _, comment := range page.Data {
+		result.Data = append(result.Data, CommentView{Comment: comment, AuthorName: names[comment.Author]})
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// UpdateComment handles the author editing their comment
+func UpdateComment(c *gin.Context) {
+	var input CommentInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	text, err := normalizeCommentText(input.Text)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	expense, comment, author, ok := findOwnComment(ctx, c, input.Author)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$set": bson.M{"text": text, "edited_at": now, "updated_at": now}}
+	if err := db.CommentsCol.FindOneAndUpdate(ctx, bson.M{"_id": comment.ID}, update, opts).Decode(&comment); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment"})
+		return
+	}
+
+	recordEvent(commentEvent(models.EventCommentUpdated, expense, comment))
+	c.JSON(http.StatusOK, CommentView{Comment: comment, AuthorName: author.Name})
+}
+
+// DeleteComment handles the author, given by the 'identifier' query parameter, deleting their comment
+func DeleteComment(c *gin.Context) {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identifier (email, mobile_number, or name) is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	expense, comment, _, ok := findOwnComment(ctx, c, identifier)
+	if !ok {
+		return
+	}
+
+	result, err := db.CommentsCol.DeleteOne(ctx, bson.M{"_id": comment.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete comment"})
+		return
+	}
+	if result.DeletedCount > 0 {
+		if _, err := db.ExpensesCol.UpdateOne(ctx, bson.M{"_id": comment.ExpenseID}, bson.M{"$inc": bson.M{"comment_count": -1}}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update comment count"})
+			return
+		}
+		comment.Text = ""
+		recordEvent(commentEvent(models.EventCommentDeleted, expense, comment))
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// commentAccess loads the expense given by :id and the user given by
+// identifier, who must be its creator or a participant. On failure it writes
+// the error response and returns false.
+func commentAccess(ctx context.Context, c *gin.Context, identifier string) (models.Expense, models.User, bool) {
+	var expense models.Expense
+	expenseID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expense id"})
+		return expense, models.User{}, false
+	}
+
+	user, err := identifyUser(identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return expense, user, false
+	}
+
+	if err := db.ExpensesCol.FindOne(ctx, bson.M{"_id": expenseID}).Decode(&expense); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Expense not found"})
+			return expense, user, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch expense"})
+		return expense, user, false
+	}
+
+	if !isExpenseMember(expense, user.ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only participants of the expense can see its comments"})
+		return expense, user, false
+	}
+	return expense, user, true
+}
+
+// findOwnComment loads the expense and comment given by :id and :comment_id.
+// The comment must have been written by the user given by identifier. On
+// failure it writes the error response and returns false.
+func findOwnComment(ctx context.Context, c *gin.Context, identifier string) (models.Expense, models.Comment, models.User, bool) {
+	var comment models.Comment
+	commentID, err := primitive.ObjectIDFromHex(c.Param("comment_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment id"})
+		return models.Expense{}, comment, models.User{}, false
+	}
+
+	expense, author, ok := commentAccess(ctx, c, identifier)
+	if !ok {
+		return expense, comment, author, false
+	}
+
+	if err := db.CommentsCol.FindOne(ctx, bson.M{"_id": commentID, "expense_id": expense.ID}).Decode(&comment); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+			return expense, comment, author, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch comment"})
+		return expense, comment, author, false
+	}
+	if comment.Author != author.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the author can change a comment"})
+		return expense, comment, author, false
+	}
+	return expense, comment, author, true
+}
+
+// commentEvent builds an event about a comment, concerning everyone on the expense
+func commentEvent(eventType string, expense models.Expense, comment models.Comment) models.Event {
+	data := bson.M{"comment_id": comment.ID}
+	if comment.Text != "" {
+		data["excerpt"] = commentExcerpt(comment.Text)
+	}
+	return expenseEvent(eventType, expense, &comment.Author, data)
+}
+
+// commentExcerpt shortens a comment to commentExcerptLength characters, so
+// events copied to feeds and webhooks don't carry the whole text
+func commentExcerpt(text string) string {
+	if utf8.RuneCountInString(text) <= commentExcerptLength {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:commentExcerptLength-1])) + "…"
+}
+
+// isExpenseMember reports whether the user created or takes part in the expense
+func isExpenseMember(expense models.Expense, userID primitive.ObjectID) bool {
+	if expense.CreatedBy == userID {
+		return true
+	}
+	for _, p := range expense.Participants {
+		if p == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// userNames looks up the names of the comments' authors
+func userNames(ctx context.Context, comments []models.Comment) (map[primitive.ObjectID]string, error) {
+	names := map[primitive.ObjectID]string{}
+	ids := []primitive.ObjectID{}
+	for _, comment := range comments {
+		if _, ok := names[comment.Author]; !ok {
+			names[comment.Author] = ""
+			ids = append(ids, comment.Author)
+		}
+	}
+	if len(ids) == 0 {
+		return names, nil
+	}
+
+	opts := options.Find().SetProjection(bson.M{"name": 1})
+	cursor, err := db.UsersCol.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		names[user.ID] = user.Name
+	}
+	return names, nil
+}
+
+// normalizeCommentText trims a comment and checks its length
+func normalizeCommentText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("Comment text is required")
+	}
+	if utf8.RuneCountInString(text) > maxCommentLength {
+		return "", errors.New("Comment text may be at most " + strconv.Itoa(maxCommentLength) + " characters")
+	}
+	return text, nil
+}
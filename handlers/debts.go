@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// userDebts returns what the user owes each other user per currency: their
+// shares of expenses the other user paid for, less the other user's shares of
+// expenses the user paid for, adjusted by the settlements between them.
+// Negative amounts are owed to the user.
+func userDebts(ctx context.Context, user models.User) (map[primitive.ObjectID]map[string]float64, error) {
+	filter := bson.M{"$or": []bson.M{
+		{"created_by": user.ID},
+		{"participants": user.ID},
+	}}
+	cursor, err := db.ExpensesCol.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	expenses := []models.Expense{}
+	if err := cursor.All(ctx, &expenses); err != nil {
+		return nil, err
+	}
+
+	debts := map[primitive.ObjectID]map[string]float64{}
+	add := func(other primitive.ObjectID, currency string, amount float64) {
+		if debts[other] == nil {
+			debts[other] = map[string]float64{}
+		}
+		debts[other][currency] += amount
+	}
+
+	// Older expenses key split_details by email, so the other participants'
+	// split keys are needed for the expenses the user paid for
+	others := []primitive.ObjectID{}
+	for _, expense := range expenses {
+		if expense.CreatedBy == user.ID {
+			others = append(others, expense.Participants...)
+		}
+	}
+	otherKeys, err := splitKeysByUser(ctx, uniqueIDs(others))
+	if err != nil {
+		return nil, err
+	}
+
+	userKeys := userSplitKeys(user)
+	for _, expense := range expenses {
+		currency := utils.NormalizeCurrency(expense.Currency)
+		if expense.CreatedBy != user.ID {
+			if amount, ok := splitAmountFor(expense.SplitDetails, userKeys); ok {
+				add(expense.CreatedBy, currency, amount)
+			}
+			continue
+		}
+		for _, participant := range expense.Participants {
+			if participant == user.ID {
+				continue
+			}
+			if amount, ok := splitAmountFor(expense.SplitDetails, otherKeys[participant]); ok {
+				add(participant, currency, -amount)
+			}
+		}
+	}
+
+	cursor, err = db.SettlementsCol.Find(ctx, bson.M{"$or": []bson.M{
+		{"payer": user.ID},
+		{"payee": user.ID},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	settlements := []models.Settlement{}
+	if err := cursor.All(ctx, &settlements); err != nil {
+		return nil, err
+	}
+	for _, s := range settlements {
+		switch {
+		case s.Payer == s.Payee:
+			// Left behind by merging the two users
+		case s.Payer == user.ID:
+			add(s.Payee, s.Currency, -s.Amount)
+		default:
+			add(s.Payer, s.Currency, s.Amount)
+		}
+	}
+
+	// Drop balances that net out to less than the currency's minor unit, allowing
+	// for rounding in split amounts
+	for other, amounts := range debts {
+		for currency, amount := range amounts {
+			if utils.RoundAmount(amount, currency) == 0 {
+				delete(amounts, currency)
+			}
+		}
+		if len(amounts) == 0 {
+			delete(debts, other)
+		}
+	}
+	return debts, nil
+}
+
+// splitKeysByUser looks up the split_details keys of the given users
+func splitKeysByUser(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID][]string, error) {
+	keys := map[primitive.ObjectID][]string{}
+	if len(ids) == 0 {
+		return keys, nil
+	}
+	opts := options.Find().SetProjection(bson.M{"email": 1, "previous_emails": 1})
+	cursor, err := db.UsersCol.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		keys[id] = []string{id.Hex()}
+	}
+	for _, u := range users {
+		keys[u.ID] = userSplitKeys(u)
+	}
+	return keys, nil
+}
+
+// positiveAmounts keeps the currencies with an amount owed
+func positiveAmounts(amounts map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for currency, amount := range amounts {
+		if amount > 0 {
+			result[currency] = amount
+		}
+	}
+	return result
+}
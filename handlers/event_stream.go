@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxReplayEvents bounds how many missed events a reconnecting client is sent
+	maxReplayEvents    = 1000
+	streamHeartbeat    = 25 * time.Second
+	subscriberBuffer   = 64
+	changeStreamRetry  = 5 * time.Second
+	balanceChangeEvent = "balance.changed"
+)
+
+// balanceChangingEvents are the event types that change the balances of the users they concern
+var balanceChangingEvents = map[string]bool{
+	models.EventExpenseCreated:    true,
+	models.EventSettlementCreated: true,
+}
+
+// eventHub fans out newly recorded events to the open event streams
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan models.Event]primitive.ObjectID
+	// inProcess is set when there is no change stream, so recordEvent publishes
+	// directly and only clients of this server instance see live events
+	inProcess atomic.Bool
+}
+
+var streamHub = &eventHub{subscribers: map[chan models.Event]primitive.ObjectID{}}
+
+// subscribe returns a channel receiving the events concerning userID
+func (h *eventHub) subscribe(userID primitive.ObjectID) chan models.Event {
+	ch := make(chan models.Event, subscriberBuffer)
+	h.mu.Lock()
+	h.subscribers[ch] = userID
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan models.Event) {
+	h.mu.Lock()
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+	h.mu.Unlock()
+}
+
+// publish sends event to the subscribers it concerns. A subscriber that falls
+// behind is dropped; its client reconnects and catches up from the event log.
+func (h *eventHub) publish(event models.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, userID := range h.subscribers {
+		if !containsID(event.Users, userID) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// StartEventStream feeds the event streams from a MongoDB change stream on the
+// events collection, so events recorded by any server instance are pushed. Change
+// streams need a replica set; on a standalone server events are published in-process.
+func StartEventStream() {
+	stream, err := db.EventsCol.Watch(context.Background(), insertedEvents())
+	if err != nil {
+		log.Printf("Change streams unavailable, streaming events in-process only: %v", err)
+		streamHub.inProcess.Store(true)
+		return
+	}
+	go watchEvents(stream)
+}
+
+func insertedEvents() mongo.Pipeline {
+	return mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+}
+
+// watchEvents publishes events from the change stream, resuming it after errors
+func watchEvents(stream *mongo.ChangeStream) {
+	ctx := context.Background()
+	for {
+		for stream.Next(ctx) {
+			var change struct {
+				FullDocument models.Event `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("Failed to decode change stream event: %v", err)
+				continue
+			}
+			streamHub.publish(change.FullDocument)
+		}
+
+		log.Printf("Event change stream stopped, resuming: %v", stream.Err())
+		token := stream.ResumeToken()
+		stream.Close(ctx)
+		for {
+			time.Sleep(changeStreamRetry)
+			var err error
+			stream, err = db.EventsCol.Watch(ctx, insertedEvents(), options.ChangeStream().SetResumeAfter(token))
+			if err == nil {
+				break
+			}
+			log.Printf("Failed to resume event change stream: %v", err)
+		}
+	}
+}
+
+// StreamEvents handles a Server-Sent Events stream of the events concerning the
+// user given by the 'identifier' query parameter. Clients resume after a
+// disconnect with the Last-Event-ID header (or 'last_event_id' query parameter)
+// and are first sent the events they missed.
+func StreamEvents(c *gin.Context) {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identifier (email, mobile_number, or name) is required"})
+		return
+	}
+
+	user, err := identifyUser(identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	var lastID primitive.ObjectID
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		lastID, err = primitive.ObjectIDFromHex(lastEventID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	// Subscribe before replaying so nothing recorded in between is missed
+	events := streamHub.subscribe(user.ID)
+	defer streamHub.unsubscribe(events)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+
+	replayed := map[primitive.ObjectID]bool{}
+	if !lastID.IsZero() {
+		missed, err := replayEvents(c.Request.Context(), user.ID, lastID)
+		if err != nil {
+			log.Printf("Failed to replay events: %v", err)
+			return
+		}
+		for _, event := range missed {
+			if writeStreamEvent(c, event) != nil {
+				return
+			}
+			replayed[event.ID] = true
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// Dropped for falling behind; the client reconnects with Last-Event-ID
+				return
+			}
+			// Skip events already sent while replaying
+			if replayed[event.ID] {
+				continue
+			}
+			if writeStreamEvent(c, event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// replayEvents returns the user's events recorded after lastID, oldest first
+func replayEvents(ctx context.Context, userID, lastID primitive.ObjectID) ([]models.Event, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(maxReplayEvents)
+	cursor, err := db.EventsCol.Find(ctx, bson.M{"users": userID, "_id": bson.M{"$gt": lastID}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.Event{}
+	err = cursor.All(ctx, &events)
+	return events, err
+}
+
+// writeStreamEvent writes an event as an SSE message. Events that change
+// balances are followed by a balance.changed message with the same id.
+func writeStreamEvent(c *gin.Context, event models.Event) error {
+	if err := writeSSE(c, event.ID.Hex(), event.Type, event); err != nil {
+		return err
+	}
+	if balanceChangingEvents[event.Type] {
+		change := gin.H{"users": event.Users, "cause": event.Type}
+		if event.ExpenseID != nil {
+			change["expense_id"] = event.ExpenseID
+		}
+		if currency, ok := event.Data["currency"]; ok {
+			change["currency"] = currency
+		}
+		if err := writeSSE(c, event.ID.Hex(), balanceChangeEvent, change); err != nil {
+			return err
+		}
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+func writeSSE(c *gin.Context, id, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", id, eventType, payload)
+	return err
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
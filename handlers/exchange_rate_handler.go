@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/utils"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rateDateLayout is the format of exchange rate effective dates
+const rateDateLayout = "2006-01-02"
+
+type ExchangeRateInput struct {
+	Date string  `json:"date"`
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Rate float64 `json:"rate"`
+}
+
+// ImportExchangeRates handles loading exchange rates from a JSON array or a CSV body
+// with a "date,from,to,rate" header. Existing rates for the same pair and date are replaced.
+func ImportExchangeRates(c *gin.Context) {
+	format := "json"
+	if strings.HasPrefix(c.ContentType(), "text/csv") {
+		format = "csv"
+	}
+
+	rates, err := parseExchangeRates(c.Request.Body, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := saveExchangeRates(ctx, rates); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save exchange rates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imported": len(rates)})
+}
+
+// GetExchangeRates handles listing exchange rates, optionally filtered by 'from' and 'to'
+func GetExchangeRates(c *gin.Context) {
+	filter := bson.M{}
+	if from := c.Query("from"); from != "" {
+		filter["from"] = utils.NormalizeCurrency(from)
+	}
+	if to := c.Query("to"); to != "" {
+		filter["to"] = utils.NormalizeCurrency(to)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().SetSort(bson.D{
+		{Key: "from", Value: 1},
+		{Key: "to", Value: 1},
+		{Key: "effective_date", Value: -1},
+	})
+	cursor, err := db.RatesCol.Find(ctx, filter, findOptions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve exchange rates"})
+		return
+	}
+
+	rates := []models.ExchangeRate{}
+	if err := cursor.All(ctx, &rates); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse exchange rates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rates)
+}
+
+// LoadExchangeRatesFile imports exchange rates from a .csv or .json file
+func LoadExchangeRatesFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	format := "json"
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = "csv"
+	}
+
+	rates, err := parseExchangeRates(f, format)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := saveExchangeRates(ctx, rates); err != nil {
+		return 0, err
+	}
+	return len(rates), nil
+}
+
+// parseExchangeRates reads and validates rates in "json" or "csv" format
+func parseExchangeRates(r io.Reader, format string) ([]models.ExchangeRate, error) {
+	inputs := []ExchangeRateInput{}
+	switch format {
+	case "csv":
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		if len(records) == 0 {
+			return nil, errors.New("CSV is empty")
+		}
+		columns := map[string]int{}
+		for i, name := range records[0] {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		for _, name := range []string{"date", "from", "to", "rate"} {
+			if _, ok := columns[name]; !ok {
+				return nil, fmt.Errorf("CSV header must include '%s'", name)
+			}
+		}
+		for line, record := range records[1:] {
+			rate, err := strconv.ParseFloat(strings.TrimSpace(record[columns["rate"]]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate on line %d", line+2)
+			}
+			inputs = append(inputs, ExchangeRateInput{
+				Date: record[columns["date"]],
+				From: record[columns["from"]],
+				To:   record[columns["to"]],
+				Rate: rate,
+			})
+		}
+	default:
+		if err := json.NewDecoder(r).Decode(&inputs); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	}
+
+	now := time.Now()
+	rates := make([]models.ExchangeRate, 0, len(inputs))
+	for i, input := range inputs {
+		date, err := time.Parse(rateDateLayout, strings.TrimSpace(input.Date))
+		if err != nil {
+			return nil, fmt.Errorf("rate %d: date must be formatted as YYYY-MM-DD", i+1)
+		}
+		// NormalizeCurrency reads an empty code as the default currency
+		if strings.TrimSpace(input.From) == "" || strings.TrimSpace(input.To) == "" {
+			return nil, fmt.Errorf("rate %d: from and to are required", i+1)
+		}
+		from := utils.NormalizeCurrency(input.From)
+		to := utils.NormalizeCurrency(input.To)
+		if _, ok := utils.MinorUnits(from); !ok {
+			return nil, fmt.Errorf("rate %d: unsupported currency '%s'", i+1, from)
+		}
+		if _, ok := utils.MinorUnits(to); !ok {
+			return nil, fmt.Errorf("rate %d: unsupported currency '%s'", i+1, to)
+		}
+		if from == to {
+			return nil, fmt.Errorf("rate %d: currencies must differ", i+1)
+		}
+		if input.Rate <= 0 {
+			return nil, fmt.Errorf("rate %d: rate must be greater than 0", i+1)
+		}
+		rates = append(rates, models.ExchangeRate{
+			From:          from,
+			To:            to,
+			Rate:          input.Rate,
+			EffectiveDate: date,
+			CreatedAt:     now,
+		})
+	}
+	return rates, nil
+}
+
+// saveExchangeRates upserts rates by currency pair and effective date
+func saveExchangeRates(ctx context.Context, rates []models.ExchangeRate) error {
+	if len(rates) == 0 {
+		return nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(rates))
+	for _, rate := range rates {
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"from": rate.From, "to": rate.To, "effective_date": rate.EffectiveDate}).
+			SetReplacement(rate).
+			SetUpsert(true))
+	}
+	_, err := db.RatesCol.BulkWrite(ctx, writes)
+	return err
+}
+
+// errNoExchangeRate is wrapped by currencyConverter.Convert when no rate applies
+var errNoExchangeRate = errors.New("no exchange rate")
+
+// currencyConverter converts amounts into a target currency using the rate
+// effective on a given date, loading each pair's rates once
+type currencyConverter struct {
+	target string
+	rates  map[string][]models.ExchangeRate
+}
+
+func newCurrencyConverter(target string) *currencyConverter {
+	return &currencyConverter{target: target, rates: map[string][]models.ExchangeRate{}}
+}
+
+// parseConvertTo returns a converter into the currency of the optional
+// 'convert_to' query parameter, or nil when it isn't given. On failure it
+// writes the error response and returns false.
+func parseConvertTo(c *gin.Context) (*currencyConverter, bool) {
+	convertTo := c.Query("convert_to")
+	if convertTo == "" {
+		return nil, true
+	}
+	convertTo = utils.NormalizeCurrency(convertTo)
+	if _, ok := utils.MinorUnits(convertTo); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency '" + convertTo + "'"})
+		return nil, false
+	}
+	return newCurrencyConverter(convertTo), true
+}
+
+// Convert converts amount in currency from into the target currency at date.
+// An inverse rate (target to from) is used when no direct rate exists.
+func (cc *currencyConverter) Convert(ctx context.Context, amount float64, from string, date time.Time) (float64, error) {
+	if from == cc.target {
+		return amount, nil
+	}
+	if rate, ok, err := cc.rateOn(ctx, from, cc.target, date); err != nil {
+		return 0, err
+	} else if ok {
+		return amount * rate, nil
+	}
+	if rate, ok, err := cc.rateOn(ctx, cc.target, from, date); err != nil {
+		return 0, err
+	} else if ok {
+		return amount / rate, nil
+	}
+	return 0, fmt.Errorf("%w from %s to %s effective on %s", errNoExchangeRate, from, cc.target, date.Format(rateDateLayout))
+}
+
+// rateOn returns the latest from/to rate effective on or before date
+func (cc *currencyConverter) rateOn(ctx context.Context, from, to string, date time.Time) (float64, bool, error) {
+	key := from + "/" + to
+	rates, ok := cc.rates[key]
+	if !ok {
+		findOptions := options.Find().SetSort(bson.D{{Key: "effective_date", Value: 1}})
+		cursor, err := db.RatesCol.Find(ctx, bson.M{"from": from, "to": to}, findOptions)
+		if err != nil {
+			return 0, false, err
+		}
+		rates = []models.ExchangeRate{}
+		if err := cursor.All(ctx, &rates); err != nil {
+			return 0, false, err
+		}
+		cc.rates[key] = rates
+	}
+
+	// First rate effective after date; the one before it applies
+	i := sort.Search(len(rates), func(i int) bool {
+		return rates[i].EffectiveDate.After(date)
+	})
+	if i == 0 {
+		return 0, false, nil
+	}
+	return rates[i-1].Rate, true, nil
+}
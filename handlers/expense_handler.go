@@ -2,10 +2,11 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"expenses-backend/db"
 	"expenses-backend/models"
+	"expenses-backend/utils"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
@@ -13,20 +14,39 @@ import (
 	"github.com/go-playground/validator/v10"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type ExpenseInput struct {
-	Description  string                 `json:"description" binding:"required"`
-	Amount       float64                `json:"amount" binding:"required,gt=0"`
+	Description string   `json:"description" binding:"required"`
+	Amount      float64  `json:"amount" binding:"required,gt=0"`
+	Currency    string   `json:"currency,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// ExpenseDate is when the expense happened, YYYY-MM-DD or RFC 3339; defaults to now
+	ExpenseDate string `json:"expense_date,omitempty"`
+	// Timezone is an IANA zone such as Asia/Kolkata used to interpret a plain expense_date
+	Timezone     string                 `json:"timezone,omitempty"`
 	CreatedBy    string                 `json:"created_by" binding:"required"`
 	SplitType    string                 `json:"split_type" binding:"required,oneof=Equal Exact Percentage"`
 	Participants []string               `json:"participants" binding:"required,min=1"`
 	SplitDetails map[string]interface{} `json:"split_details,omitempty"`
+	// CreatePlaceholders creates unclaimed users for unknown participant emails or mobile numbers
+	CreatePlaceholders bool `json:"create_placeholders,omitempty"`
 }
 
 var expenseValidate = validator.New()
 
+// UserExpense is an expense listed for a user, with that user's share of it
+type UserExpense struct {
+	models.Expense
+	MyShare  float64 `json:"my_share"`
+	PaidByMe bool    `json:"paid_by_me"`
+	// Set with 'convert_to', at the rate effective on the expense date
+	ConvertedCurrency string   `json:"converted_currency,omitempty"`
+	ConvertedAmount   *float64 `json:"converted_amount,omitempty"`
+	ConvertedMyShare  *float64 `json:"converted_my_share,omitempty"`
+}
+
 // AddExpense handles adding a new expense
 func AddExpense(c *gin.Context) {
 	var input ExpenseInput
@@ -41,23 +61,133 @@ func AddExpense(c *gin.Context) {
 		return
 	}
 
+	participants := newParticipantResolver(input.CreatePlaceholders)
+	expense, suggestion, reqErr := buildExpense(input, participants)
+	if reqErr != nil {
+		c.JSON(reqErr.Status, reqErr.Body)
+		return
+	}
+
+	// Insert into MongoDB
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Placeholder users are only created along with the expense that needs them
+	err := participants.withPlaceholders(ctx, &expense, func(ctx context.Context) error {
+		expense.ID = primitive.NewObjectID()
+		_, err := db.ExpensesCol.InsertOne(ctx, expense)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create expense"})
+		return
+	}
+
+	recordEvent(expenseEvent(models.EventExpenseCreated, expense, &expense.CreatedBy, nil))
+	go notifyExpenseAdded(expense)
+	go evaluateBudgets(expense)
+
+	if suggestion != nil {
+		c.JSON(http.StatusCreated, struct {
+			models.Expense
+			CategorySuggestion *CategorySuggestion `json:"category_suggestion"`
+		}{expense, suggestion})
+		return
+	}
+
+	c.JSON(http.StatusCreated, expense)
+}
+
+// requestError is an error response produced outside a handler
+type requestError struct {
+	Status int
+	Body   gin.H
+}
+
+func (e *requestError) Error() string {
+	msg, _ := e.Body["error"].(string)
+	return msg
+}
+
+// identifyRequestError turns an identifyUser error into a request error, keeping
+// database failures from looking like a bad identifier
+func identifyRequestError(prefix string, err error) *requestError {
+	if identifyErrorStatus(err) == http.StatusBadRequest {
+		return &requestError{http.StatusBadRequest, identifyErrorResponse(prefix, err)}
+	}
+	return &requestError{http.StatusInternalServerError, gin.H{"error": "Failed to identify users"}}
+}
+
+// buildExpense validates an expense input, resolves its users and category and
+// computes the split. It is shared by AddExpense and recurring expenses. Nothing
+// is written; placeholder participants are left planned in participants.
+func buildExpense(input ExpenseInput, participants *participantResolver) (models.Expense, *CategorySuggestion, *requestError) {
 	input.Description = strings.TrimSpace(input.Description)
 	input.SplitType = strings.TrimSpace(input.SplitType)
+	input.Currency = utils.NormalizeCurrency(input.Currency)
+
+	if _, ok := utils.MinorUnits(input.Currency); !ok {
+		return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Unsupported currency '" + input.Currency + "'"}}
+	}
+	if !utils.HasValidPrecision(input.Amount, input.Currency) {
+		return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Amount has more decimal places than " + input.Currency + " allows"}}
+	}
 
 	// Identify creator
 	creator, err := identifyUser(input.CreatedBy)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'created_by' identifier: " + err.Error()})
-		return
+		return models.Expense{}, nil, identifyRequestError("Invalid 'created_by' identifier: ", err)
+	}
+
+	now := time.Now()
+	expenseDate := now
+	input.Timezone = strings.TrimSpace(input.Timezone)
+	if input.Timezone != "" {
+		if _, err := time.LoadLocation(input.Timezone); err != nil {
+			return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Unknown timezone '" + input.Timezone + "'"}}
+		}
+	}
+	if strings.TrimSpace(input.ExpenseDate) != "" {
+		expenseDate, err = parseExpenseDate(strings.TrimSpace(input.ExpenseDate), input.Timezone)
+		if err != nil {
+			return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": err.Error()}}
+		}
+	}
+
+	tags, err := normalizeTags(input.Tags)
+	if err != nil {
+		return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": err.Error()}}
+	}
+
+	// Resolve category, suggesting one from the description when none is given
+	categoryCtx, categoryCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var category, categorySource string
+	var suggestion *CategorySuggestion
+	if strings.TrimSpace(input.Category) != "" {
+		category, err = resolveCategory(categoryCtx, input.Category, creator.ID)
+		categorySource = CategorySourceUser
+	} else {
+		var s CategorySuggestion
+		s, err = suggestCategory(categoryCtx, input.Description, creator.ID)
+		category, categorySource, suggestion = s.Category, CategorySourceSuggested, &s
+		if s.Source == "default" {
+			categorySource = CategorySourceDefault
+		}
+	}
+	categoryCancel()
+	if err != nil {
+		if errors.Is(err, errUnknownCategory) {
+			return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Invalid category: " + err.Error()}}
+		}
+		return models.Expense{}, nil, &requestError{http.StatusInternalServerError, gin.H{"error": "Failed to resolve category"}}
 	}
 
 	// Identify participants
 	participantIDs := []primitive.ObjectID{}
 	for _, p := range input.Participants {
-		user, err := identifyUser(p)
+		user, err := participants.identify(p)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid participant identifier '" + p + "': " + err.Error()})
-			return
+			return models.Expense{}, nil, identifyRequestError("Invalid participant identifier '"+p+"': ", err)
 		}
 		participantIDs = append(participantIDs, user.ID)
 	}
@@ -72,107 +202,87 @@ func AddExpense(c *gin.Context) {
 		}
 	case "Exact":
 		if input.SplitDetails == nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "split_details required for Exact split"})
-			return
+			return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "split_details required for Exact split"}}
 		}
 		total := 0.0
 		for _, v := range input.SplitDetails {
 			amount, ok := convertToFloat64(v)
 			if !ok {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount in split_details"})
-				return
+				return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Invalid amount in split_details"}}
 			}
 			total += amount
 		}
 		if !almostEqual(total, input.Amount, 0.01) { // Allow small rounding differences
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Sum of exact amounts does not equal total amount"})
-			return
+			return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Sum of exact amounts does not equal total amount"}}
 		}
 		for k, v := range input.SplitDetails {
-			user, err := identifyUser(k)
+			user, err := participants.identify(k)
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid participant identifier '" + k + "': " + err.Error()})
-				return
+				return models.Expense{}, nil, identifyRequestError("Invalid participant identifier '"+k+"': ", err)
 			}
 			amount, ok := convertToFloat64(v)
 			if !ok {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount for user '" + k + "' in split_details"})
-				return
+				return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Invalid amount for user '" + k + "' in split_details"}}
+			}
+			if !utils.HasValidPrecision(amount, input.Currency) {
+				return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Amount for user '" + k + "' has more decimal places than " + input.Currency + " allows"}}
 			}
 			splits[user.ID] = amount
 		}
 	case "Percentage":
 		if input.SplitDetails == nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "split_details required for Percentage split"})
-			return
+			return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "split_details required for Percentage split"}}
 		}
 		totalPercent := 0.0
 		for _, v := range input.SplitDetails {
 			percentage, ok := convertToFloat64(v)
 			if !ok {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid percentage in split_details"})
-				return
+				return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Invalid percentage in split_details"}}
 			}
 			totalPercent += percentage
 		}
 		if !almostEqual(totalPercent, 100.0, 0.01) { // Allow small rounding differences
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Sum of percentages must be exactly 100%"})
-			return
+			return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Sum of percentages must be exactly 100%"}}
 		}
 		for k, v := range input.SplitDetails {
-			user, err := identifyUser(k)
+			user, err := participants.identify(k)
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid participant identifier '" + k + "': " + err.Error()})
-				return
+				return models.Expense{}, nil, identifyRequestError("Invalid participant identifier '"+k+"': ", err)
 			}
 			percentage, ok := convertToFloat64(v)
 			if !ok {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid percentage for user '" + k + "' in split_details"})
-				return
+				return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Invalid percentage for user '" + k + "' in split_details"}}
 			}
 			splits[user.ID] = (percentage / 100.0) * input.Amount
 		}
 	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid split_type"})
-		return
+		return models.Expense{}, nil, &requestError{http.StatusBadRequest, gin.H{"error": "Invalid split_type"}}
 	}
 
 	// Create Expense
 	expense := models.Expense{
-		Description:  input.Description,
-		Amount:       input.Amount,
-		CreatedBy:    creator.ID,
-		SplitType:    input.SplitType,
-		Participants: participantIDs,
-		SplitDetails: make(map[string]interface{}),
-		CreatedAt:    time.Now(),
+		Description:    input.Description,
+		Amount:         input.Amount,
+		Currency:       input.Currency,
+		Category:       category,
+		CategorySource: categorySource,
+		Tags:           tags,
+		CreatedBy:      creator.ID,
+		SplitType:      input.SplitType,
+		Participants:   participantIDs,
+		SplitDetails:   make(map[string]interface{}),
+		ExpenseDate:    expenseDate,
+		Timezone:       input.Timezone,
+		CreatedAt:      now,
+		UpdatedAt:      now,
 	}
 
-	// Prepare split_details with user identifiers (e.g., email)
+	// Key split_details by user ID so later email or mobile changes don't orphan the expense
 	for pid, amt := range splits {
-		// Fetch user's email for split_details
-		var user models.User
-		err := db.UsersCol.FindOne(context.Background(), bson.M{"_id": pid}).Decode(&user)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch participant details"})
-			return
-		}
-		expense.SplitDetails[user.Email] = amt
-	}
-
-	// Insert into MongoDB
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	result, err := db.ExpensesCol.InsertOne(ctx, expense)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create expense"})
-		return
+		expense.SplitDetails[pid.Hex()] = amt
 	}
 
-	expense.ID = result.InsertedID.(primitive.ObjectID)
-
-	c.JSON(http.StatusCreated, expense)
+	return expense, suggestion, nil
 }
 
 // Helper function to check if two floats are almost equal
@@ -206,84 +316,116 @@ func GetUserExpenses(c *gin.Context) {
 
 	user, err := identifyUser(identifier)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identifier: " + err.Error()})
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	filter := bson.M{
-		"$or": []bson.M{
+	filter, err := parseExpenseFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("", err))
+		return
+	}
+	converter, ok := parseConvertTo(c)
+	if !ok {
+		return
+	}
+	filter = bson.M{"$and": []bson.M{
+		filter,
+		{"$or": []bson.M{
 			{"created_by": user.ID},
 			{"participants": user.ID},
-		},
-	}
+		}},
+	}}
 
-	cursor, err := db.ExpensesCol.Find(ctx, filter)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve expenses"})
+	page, ok := findExpensePage(c, filter)
+	if !ok {
 		return
 	}
-	defer cursor.Close(ctx)
-
-	expenses := []models.Expense{}
-	for cursor.Next(ctx) {
-		var expense models.Expense
-		if err := cursor.Decode(&expense); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse expenses"})
-			return
+
+	// Annotate each expense with the caller's own share so clients don't parse split_details
+	keys := userSplitKeys(user)
+	result := Page[UserExpense]{
+		Data:       make([]UserExpense, 0, len(page.Data)),
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+		Total:      page.Total,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, expense := range page.Data {
+		share, _ := splitAmountFor(expense.SplitDetails, keys)
+		userExpense := UserExpense{
+			Expense:  expense,
+			MyShare:  share,
+			PaidByMe: expense.CreatedBy == user.ID,
 		}
-		expenses = append(expenses, expense)
+		if converter != nil {
+			amount, err := converter.Convert(ctx, expense.Amount, expense.Currency, expense.ExpenseDate)
+			if err != nil {
+				c.JSON(balanceErrorStatus(err), gin.H{"error": "Failed to convert amounts: " + err.Error()})
+				return
+			}
+			myShare, err := converter.Convert(ctx, share, expense.Currency, expense.ExpenseDate)
+			if err != nil {
+				c.JSON(balanceErrorStatus(err), gin.H{"error": "Failed to convert amounts: " + err.Error()})
+				return
+			}
+			amount = utils.RoundAmount(amount, converter.target)
+			myShare = utils.RoundAmount(myShare, converter.target)
+			userExpense.ConvertedCurrency = converter.target
+			userExpense.ConvertedAmount = &amount
+			userExpense.ConvertedMyShare = &myShare
+		}
+		result.Data = append(result.Data, userExpense)
 	}
 
-	c.JSON(http.StatusOK, expenses)
+	c.JSON(http.StatusOK, result)
 }
 
 // GetOverallExpenses handles retrieving all expenses
 func GetOverallExpenses(c *gin.Context) {
-	// Pagination parameters
-	pageStr := c.DefaultQuery("page", "1")
-	limitStr := c.DefaultQuery("limit", "10")
-
-	page, err := strconv.Atoi(pageStr)
-	if err != nil || page < 1 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page parameter"})
+	filter, err := parseExpenseFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("", err))
 		return
 	}
 
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil || limit < 1 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+	page, ok := findExpensePage(c, filter)
+	if !ok {
 		return
 	}
 
-	skip := (page - 1) * limit
+	c.JSON(http.StatusOK, page)
+}
+
+// findExpensePage fetches one page of the expenses matching filter using the
+// sort and pagination query parameters. On failure it writes the error response
+// and returns false.
+func findExpensePage(c *gin.Context, filter bson.M) (Page[models.Expense], bool) {
+	sort, err := parseExpenseSort(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return Page[models.Expense]{}, false
+	}
+
+	params, err := parsePageParams(c, maxPageLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return Page[models.Expense]{}, false
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	findOptions := options.Find()
-	findOptions.SetSkip(int64(skip))
-	findOptions.SetLimit(int64(limit))
-	findOptions.SetSort(bson.D{{"created_at", -1}})
-
-	cursor, err := db.ExpensesCol.Find(ctx, bson.M{}, findOptions)
+	page, err := findPage(ctx, db.ExpensesCol, filter, sort, params, expenseSortKey(sort))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve expenses"})
-		return
-	}
-	defer cursor.Close(ctx)
-
-	expenses := []models.Expense{}
-	for cursor.Next(ctx) {
-		var expense models.Expense
-		if err := cursor.Decode(&expense); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse expenses"})
-			return
+		if errors.Is(err, errCursorSortMismatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return page, false
 		}
-		expenses = append(expenses, expense)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve expenses"})
+		return page, false
 	}
 
-	c.JSON(http.StatusOK, expenses)
+	return page, true
 }
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"expenses-backend/models"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// expenseSortFields maps the values accepted by the 'sort' query parameter to document fields
+var expenseSortFields = map[string]string{
+	"expense_date": "expense_date",
+	"created_at":   "created_at",
+	"amount":       "amount",
+	"description":  "description",
+	"category":     "category",
+	"split_type":   "split_type",
+}
+
+// parseExpenseFilter builds a Mongo filter from the listing query parameters:
+// from, to, min_amount, max_amount, split_type, created_by, participant,
+// category, tag, tag_match and q (text search over the description)
+func parseExpenseFilter(c *gin.Context) (bson.M, error) {
+	filter := bson.M{}
+
+	dateRange := bson.M{}
+	if from := c.Query("from"); from != "" {
+		t, _, err := parseQueryTime(from)
+		if err != nil {
+			return nil, errors.New("invalid 'from' date, use YYYY-MM-DD or RFC 3339")
+		}
+		dateRange["$gte"] = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, dateOnly, err := parseQueryTime(to)
+		if err != nil {
+			return nil, errors.New("invalid 'to' date, use YYYY-MM-DD or RFC 3339")
+		}
+		if dateOnly {
+			// A plain date includes the whole day
+			dateRange["$lt"] = t.AddDate(0, 0, 1)
+		} else {
+			dateRange["$lte"] = t
+		}
+	}
+	if len(dateRange) > 0 {
+		filter["expense_date"] = dateRange
+	}
+
+	amountRange := bson.M{}
+	if min := c.Query("min_amount"); min != "" {
+		v, err := strconv.ParseFloat(min, 64)
+		if err != nil {
+			return nil, errors.New("invalid 'min_amount'")
+		}
+		amountRange["$gte"] = v
+	}
+	if max := c.Query("max_amount"); max != "" {
+		v, err := strconv.ParseFloat(max, 64)
+		if err != nil {
+			return nil, errors.New("invalid 'max_amount'")
+		}
+		amountRange["$lte"] = v
+	}
+	if len(amountRange) > 0 {
+		filter["amount"] = amountRange
+	}
+
+	if splitType := c.Query("split_type"); splitType != "" {
+		switch splitType {
+		case "Equal", "Exact", "Percentage":
+			filter["split_type"] = splitType
+		default:
+			return nil, errors.New("split_type must be Equal, Exact or Percentage")
+		}
+	}
+
+	if createdBy := c.Query("created_by"); createdBy != "" {
+		user, err := identifyUser(createdBy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'created_by' identifier: %w", err)
+		}
+		filter["created_by"] = user.ID
+	}
+
+	if participant := c.Query("participant"); participant != "" {
+		user, err := identifyUser(participant)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'participant' identifier: %w", err)
+		}
+		filter["participants"] = user.ID
+	}
+
+	if category := c.Query("category"); category != "" {
+		filter["category"] = categoryFilter(normalizeCategory(category))
+	}
+
+	tagFilter, err := tagQueryFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	if tagFilter != nil {
+		filter["tags"] = tagFilter
+	}
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		filter["$text"] = bson.M{"$search": q}
+	}
+
+	return filter, nil
+}
+
+// parseExpenseSort parses a comma-separated 'sort' query parameter such as
+// "-amount,expense_date" into a sort document, defaulting to the most recent expense date first.
+// _id is always appended so the order is stable.
+func parseExpenseSort(c *gin.Context) (bson.D, error) {
+	sort := bson.D{}
+	seen := map[string]bool{}
+	for _, key := range strings.Split(c.DefaultQuery("sort", "-expense_date"), ",") {
+		key = strings.TrimSpace(key)
+		direction := 1
+		if strings.HasPrefix(key, "-") {
+			direction = -1
+			key = key[1:]
+		}
+		field, ok := expenseSortFields[key]
+		if !ok {
+			return nil, fmt.Errorf("cannot sort by '%s'", key)
+		}
+		if seen[field] {
+			continue
+		}
+		seen[field] = true
+		sort = append(sort, bson.E{Key: field, Value: direction})
+	}
+	sort = append(sort, bson.E{Key: "_id", Value: sort[len(sort)-1].Value})
+	return sort, nil
+}
+
+// expenseSortKey returns a function extracting an expense's values for the sort fields
+func expenseSortKey(sort bson.D) func(models.Expense) bson.D {
+	return func(e models.Expense) bson.D {
+		key := bson.D{}
+		for _, field := range sort {
+			var value interface{}
+			switch field.Key {
+			case "expense_date":
+				value = e.ExpenseDate
+			case "created_at":
+				value = e.CreatedAt
+			case "amount":
+				value = e.Amount
+			case "description":
+				value = e.Description
+			case "category":
+				value = e.Category
+			case "split_type":
+				value = e.SplitType
+			case "_id":
+				value = e.ID
+			}
+			key = append(key, bson.E{Key: field.Key, Value: value})
+		}
+		return key
+	}
+}
+
+// parseExpenseDate parses a client-supplied expense date: a YYYY-MM-DD date,
+// taken as midnight in timezone (UTC if empty), or an RFC 3339 timestamp
+func parseExpenseDate(value, timezone string) (time.Time, error) {
+	loc := time.UTC
+	if timezone != "" {
+		l, err := time.LoadLocation(timezone)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown timezone '%s'", timezone)
+		}
+		loc = l
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("expense_date must be YYYY-MM-DD or RFC 3339")
+	}
+	return t, nil
+}
+
+// parseQueryTime parses a YYYY-MM-DD date or an RFC 3339 timestamp, reporting whether it was a plain date
+func parseQueryTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MergeUsersInput struct {
+	SourceID string `json:"source_id" binding:"required"`
+}
+
+var (
+	errMergeSourceNotFound = errors.New("source user not found")
+	errMergeTargetNotFound = errors.New("target user not found")
+	errAlreadyMerged       = errors.New("user has already been merged into another account")
+)
+
+// MergeUsers handles folding a duplicate source user into the target user given by :id
+func MergeUsers(c *gin.Context) {
+	targetID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+
+	var input MergeUsersInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sourceID, err := primitive.ObjectIDFromHex(strings.TrimSpace(input.SourceID))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid source_id"})
+		return
+	}
+	if sourceID == targetID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot merge a user into itself"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	session, err := db.Client.StartSession()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+	defer session.EndSession(ctx)
+
+	var updated int
+	result, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		updated = 0
+		return mergeUsers(sc, sourceID, targetID, &updated)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errMergeSourceNotFound), errors.Is(err, errMergeTargetNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errAlreadyMerged):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge users"})
+		}
+		return
+	}
+
+	recordEvent(models.Event{
+		Type:  models.EventUserMerged,
+		Users: []primitive.ObjectID{targetID},
+		Data:  bson.M{"source_id": sourceID, "expenses_updated": updated},
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"user":             result,
+		"expenses_updated": updated,
+	})
+}
+
+// mergeUsers rewrites every expense reference from source to target and turns
+// the source into a tombstone pointing at the target. It must run in a transaction.
+func mergeUsers(ctx mongo.SessionContext, sourceID, targetID primitive.ObjectID, updated *int) (models.User, error) {
+	var source, target models.User
+	if err := db.UsersCol.FindOne(ctx, bson.M{"_id": sourceID}).Decode(&source); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return target, errMergeSourceNotFound
+		}
+		return target, err
+	}
+	if err := db.UsersCol.FindOne(ctx, bson.M{"_id": targetID}).Decode(&target); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return target, errMergeTargetNotFound
+		}
+		return target, err
+	}
+	if source.MergedInto != nil || target.MergedInto != nil {
+		return target, errAlreadyMerged
+	}
+
+	filter := bson.M{
+		"$or": []bson.M{
+			{"created_by": sourceID},
+			{"participants": sourceID},
+		},
+	}
+	cursor, err := db.ExpensesCol.Find(ctx, filter)
+	if err != nil {
+		return target, err
+	}
+	expenses := []models.Expense{}
+	if err := cursor.All(ctx, &expenses); err != nil {
+		return target, err
+	}
+
+	sourceKeys := userSplitKeys(source)
+
+	for _, expense := range expenses {
+		if expense.CreatedBy == sourceID {
+			expense.CreatedBy = targetID
+		}
+		expense.Participants = replaceParticipant(expense.Participants, sourceID, targetID)
+		expense.SplitDetails = mergeSplitDetails(expense.SplitDetails, sourceKeys, targetID.Hex())
+
+		_, err := db.ExpensesCol.UpdateOne(ctx, bson.M{"_id": expense.ID}, bson.M{"$set": bson.M{
+			"created_by":    expense.CreatedBy,
+			"participants":  expense.Participants,
+			"split_details": expense.SplitDetails,
+			"updated_at":    time.Now(),
+		}})
+		if err != nil {
+			return target, err
+		}
+		*updated++
+	}
+
+	// Recurring expenses create the target's expenses from now on. Their
+	// templates refer to users by ID hex, so those keys are rewritten too.
+	sourceHex, targetHex := sourceID.Hex(), targetID.Hex()
+	cursor, err = db.RecurringCol.Find(ctx, bson.M{"$or": []bson.M{
+		{"created_by": sourceID},
+		{"template.created_by": sourceHex},
+		{"template.participants": sourceHex},
+	}})
+	if err != nil {
+		return target, err
+	}
+	recurring := []models.RecurringExpense{}
+	if err := cursor.All(ctx, &recurring); err != nil {
+		return target, err
+	}
+	for _, r := range recurring {
+		if r.CreatedBy == sourceID {
+			r.CreatedBy = targetID
+		}
+		if r.Template.CreatedBy == sourceHex {
+			r.Template.CreatedBy = targetHex
+		}
+		r.Template.Participants = replaceParticipantKey(r.Template.Participants, sourceHex, targetHex)
+		if r.Template.SplitDetails != nil {
+			r.Template.SplitDetails = mergeSplitDetails(r.Template.SplitDetails, []string{sourceHex}, targetHex)
+		}
+
+		_, err := db.RecurringCol.UpdateOne(ctx, bson.M{"_id": r.ID}, bson.M{"$set": bson.M{
+			"created_by": r.CreatedBy,
+			"template":   r.Template,
+			"updated_at": time.Now(),
+		}})
+		if err != nil {
+			return target, err
+		}
+	}
+
+	// Comments are shown under the target's name from now on
+	if _, err := db.CommentsCol.UpdateMany(ctx, bson.M{"author": sourceID}, bson.M{"$set": bson.M{"author": targetID}}); err != nil {
+		return target, err
+	}
+
+	// Settlements count towards the target's balances
+	for _, field := range []string{"payer", "payee"} {
+		if _, err := db.SettlementsCol.UpdateMany(ctx, bson.M{field: sourceID}, bson.M{"$set": bson.M{field: targetID}}); err != nil {
+			return target, err
+		}
+	}
+
+	// Budgets move to the target, except where the target already has one for the same
+	// currency and category. Duplicate key errors would abort the transaction, so check first.
+	cursor, err = db.BudgetsCol.Find(ctx, bson.M{"user": targetID})
+	if err != nil {
+		return target, err
+	}
+	targetBudgets := []models.Budget{}
+	if err := cursor.All(ctx, &targetBudgets); err != nil {
+		return target, err
+	}
+	for _, budget := range targetBudgets {
+		if _, err := db.BudgetsCol.DeleteMany(ctx, bson.M{"user": sourceID, "currency": budget.Currency, "category": budget.Category}); err != nil {
+			return target, err
+		}
+	}
+	if _, err := db.BudgetsCol.UpdateMany(ctx, bson.M{"user": sourceID}, bson.M{"$set": bson.M{"user": targetID}}); err != nil {
+		return target, err
+	}
+
+	// Custom categories move to the target, except where the target already has one with
+	// the same name. Duplicate key errors would abort the transaction, so check first.
+	cursor, err = db.CategoriesCol.Find(ctx, bson.M{"created_by": targetID})
+	if err != nil {
+		return target, err
+	}
+	targetCategories := []models.Category{}
+	if err := cursor.All(ctx, &targetCategories); err != nil {
+		return target, err
+	}
+	duplicates := []string{}
+	for _, category := range targetCategories {
+		duplicates = append(duplicates, category.Name)
+	}
+	if _, err := db.CategoriesCol.DeleteMany(ctx, bson.M{"created_by": sourceID, "name": bson.M{"$in": duplicates}}); err != nil {
+		return target, err
+	}
+	if _, err := db.CategoriesCol.UpdateMany(ctx, bson.M{"created_by": sourceID}, bson.M{"$set": bson.M{"created_by": targetID}}); err != nil {
+		return target, err
+	}
+
+	// The source's activity shows up in the target's feed
+	if _, err := db.EventsCol.UpdateMany(ctx, bson.M{"users": sourceID}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"users": bson.M{"$setUnion": bson.A{
+			bson.M{"$setDifference": bson.A{"$users", bson.A{sourceID}}},
+			bson.A{targetID},
+		}}}}},
+	}); err != nil {
+		return target, err
+	}
+	if _, err := db.EventsCol.UpdateMany(ctx, bson.M{"actor": sourceID}, bson.M{"$set": bson.M{"actor": targetID}}); err != nil {
+		return target, err
+	}
+
+	// Users merged into the source earlier now redirect to the target directly
+	if _, err := db.UsersCol.UpdateMany(ctx, bson.M{"merged_into": sourceID}, bson.M{"$set": bson.M{"merged_into": targetID}}); err != nil {
+		return target, err
+	}
+
+	// Leave a tombstone so lookups by the source's email or mobile number redirect to the target
+	now := time.Now()
+	_, err = db.UsersCol.UpdateOne(ctx, bson.M{"_id": sourceID}, bson.M{"$set": bson.M{
+		"merged_into": targetID,
+		"merged_at":   now,
+		"updated_at":  now,
+	}})
+	if err != nil {
+		return target, err
+	}
+
+	return target, nil
+}
+
+// replaceParticipant swaps source for target, dropping the duplicate if target is already present
+func replaceParticipant(participants []primitive.ObjectID, source, target primitive.ObjectID) []primitive.ObjectID {
+	result := []primitive.ObjectID{}
+	seen := map[primitive.ObjectID]bool{}
+	for _, p := range participants {
+		if p == source {
+			p = target
+		}
+		if !seen[p] {
+			seen[p] = true
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// replaceParticipantKey is replaceParticipant for the ID hex strings of expense templates
+func replaceParticipantKey(participants []string, source, target string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, p := range participants {
+		if p == source {
+			p = target
+		}
+		if !seen[p] {
+			seen[p] = true
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// mergeSplitDetails moves the amounts stored under any of sourceKeys to targetKey, summing them
+func mergeSplitDetails(splitDetails map[string]interface{}, sourceKeys []string, targetKey string) map[string]interface{} {
+	result := make(map[string]interface{}, len(splitDetails))
+	moved := 0.0
+	found := false
+	for key, value := range splitDetails {
+		isSource := false
+		for _, k := range sourceKeys {
+			if k != "" && strings.EqualFold(key, k) {
+				isSource = true
+				break
+			}
+		}
+		if !isSource {
+			result[key] = value
+			continue
+		}
+		if amount, ok := convertToFloat64(value); ok {
+			moved += amount
+			found = true
+		}
+	}
+	if found {
+		if existing, ok := convertToFloat64(result[targetKey]); ok {
+			moved += existing
+		}
+		result[targetKey] = moved
+	}
+	return result
+}
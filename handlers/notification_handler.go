@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/notify"
+	"expenses-backend/utils"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of email, matching the fields of models.EmailPreferences
+const (
+	emailExpenseAdded = "expense_added"
+	emailReminders    = "reminders"
+	emailDigest       = "digest"
+)
+
+const (
+	emailTimeout = 30 * time.Second
+	digestPeriod = 7 * 24 * time.Hour
+)
+
+var (
+	notifier  notify.Notifier
+	publicURL string
+)
+
+// SetNotifier sets how emails are sent. publicURL is this server's externally
+// reachable base URL, used in unsubscribe links. Without a notifier no emails are sent.
+func SetNotifier(n notify.Notifier, baseURL string) {
+	notifier = n
+	publicURL = baseURL
+}
+
+// EmailPreferencesInput is the body of changing a user's email preferences; omitted fields are left as is
+type EmailPreferencesInput struct {
+	Identifier   string `json:"identifier" binding:"required"`
+	ExpenseAdded *bool  `json:"expense_added,omitempty"`
+	Reminders    *bool  `json:"reminders,omitempty"`
+	Digest       *bool  `json:"digest,omitempty"`
+}
+
+// GetEmailPreferences handles showing the email preferences of the user given by the 'identifier' query parameter
+func GetEmailPreferences(c *gin.Context) {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identifier (email, mobile_number, or name) is required"})
+		return
+	}
+
+	user, err := identifyUser(identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, user.Preferences())
+}
+
+// UpdateEmailPreferences handles turning kinds of email on or off for a user
+func UpdateEmailPreferences(c *gin.Context) {
+	var input EmailPreferencesInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := identifyUser(input.Identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	prefs := user.Preferences()
+	if input.ExpenseAdded != nil {
+		prefs.ExpenseAdded = *input.ExpenseAdded
+	}
+	if input.Reminders != nil {
+		prefs.Reminders = *input.Reminders
+	}
+	if input.Digest != nil {
+		prefs.Digest = *input.Digest
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := db.UsersCol.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"email_preferences": prefs}}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, prefs)
+}
+
+// emailKindNames describe each kind of email on the unsubscribe pages
+var emailKindNames = map[string]string{
+	emailExpenseAdded: "emails when you are added to an expense",
+	emailReminders:    "payment reminders",
+	emailDigest:       "the weekly digest",
+	"":                "all emails",
+}
+
+// ConfirmUnsubscribe handles the link at the bottom of every email. Following
+// it changes nothing, as mail scanners and link previews fetch links too; it
+// shows a page whose button POSTs to Unsubscribe.
+func ConfirmUnsubscribe(c *gin.Context) {
+	user, kind, status, message := unsubscribeTarget(c)
+	if status != http.StatusOK {
+		renderUnsubscribePage(c, status, unsubscribePage{Message: message})
+		return
+	}
+
+	renderUnsubscribePage(c, http.StatusOK, unsubscribePage{
+		Email:  user.Email,
+		Kind:   emailKindNames[kind],
+		Action: c.Request.URL.RequestURI(),
+	})
+}
+
+// Unsubscribe turns off the kind of email given by the 'type' query parameter,
+// or all of them, for the user owning the 'token'. It is POSTed by the
+// confirmation page and by mail clients' one-click unsubscribe (RFC 8058).
+func Unsubscribe(c *gin.Context) {
+	user, kind, status, message := unsubscribeTarget(c)
+	if status != http.StatusOK {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	prefs := user.Preferences()
+	switch kind {
+	case emailExpenseAdded:
+		prefs.ExpenseAdded = false
+	case emailReminders:
+		prefs.Reminders = false
+	case emailDigest:
+		prefs.Digest = false
+	case "":
+		prefs = models.EmailPreferences{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := db.UsersCol.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"email_preferences": prefs}}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email preferences"})
+		return
+	}
+
+	// The confirmation page's form is submitted by a browser and gets a page back
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		renderUnsubscribePage(c, http.StatusOK, unsubscribePage{
+			Email:   user.Email,
+			Kind:    emailKindNames[kind],
+			Message: "You will no longer receive " + emailKindNames[kind] + ".",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Unsubscribed", "email_preferences": prefs})
+}
+
+// unsubscribeTarget finds the user and kind of email an unsubscribe link is
+// for. On failure it returns the error status and message.
+func unsubscribeTarget(c *gin.Context) (models.User, string, int, string) {
+	var user models.User
+	token := c.Query("token")
+	if token == "" {
+		return user, "", http.StatusBadRequest, "Query parameter 'token' is required"
+	}
+	kind := c.Query("type")
+	if _, ok := emailKindNames[kind]; !ok {
+		return user, "", http.StatusBadRequest, "type must be expense_added, reminders or digest"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := db.UsersCol.FindOne(ctx, bson.M{"unsubscribe_token": token}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return user, "", http.StatusNotFound, "Invalid unsubscribe link"
+		}
+		return user, "", http.StatusInternalServerError, "Failed to fetch user"
+	}
+	return user, kind, http.StatusOK, ""
+}
+
+func renderUnsubscribePage(c *gin.Context, status int, page unsubscribePage) {
+	var body bytes.Buffer
+	if err := unsubscribePageTemplate.Execute(&body, page); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render page"})
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", body.Bytes())
+}
+
+// wantsEmail reports whether emails of the given kind can be sent to the user
+func wantsEmail(user models.User, kind string) bool {
+	if notifier == nil || user.Email == "" || user.Placeholder || user.MergedInto != nil {
+		return false
+	}
+	prefs := user.Preferences()
+	switch kind {
+	case emailExpenseAdded:
+		return prefs.ExpenseAdded
+	case emailReminders:
+		return prefs.Reminders
+	case emailDigest:
+		return prefs.Digest
+	}
+	return false
+}
+
+// sendEmail sends an email of the given kind to the user in the background. It
+// reports false when the user can't be sent such emails.
+func sendEmail(user models.User, kind string, tmpl emailTemplate, data interface{}) bool {
+	if !wantsEmail(user, kind) {
+		return false
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailTimeout)
+		defer cancel()
+		if err := deliverEmail(ctx, user, kind, tmpl, data); err != nil {
+			log.Printf("Failed to send %s email to user %s: %v", kind, user.ID.Hex(), err)
+		}
+	}()
+	return true
+}
+
+// deliverEmail renders an email of the given kind with an unsubscribe link and sends it to the user
+func deliverEmail(ctx context.Context, user models.User, kind string, tmpl emailTemplate, data interface{}) error {
+	token, err := unsubscribeToken(ctx, user)
+	if err != nil {
+		return err
+	}
+	unsubscribeURL := publicURL + "/notifications/unsubscribe?" + url.Values{"token": {token}, "type": {kind}}.Encode()
+
+	msg, err := tmpl.render(user.Email, emailData{Name: user.Name, UnsubscribeURL: unsubscribeURL, Data: data})
+	if err != nil {
+		return err
+	}
+	msg.Headers = map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+	return notifier.Send(ctx, msg)
+}
+
+// unsubscribeToken returns the user's unsubscribe token, creating it on first use
+func unsubscribeToken(ctx context.Context, user models.User) (string, error) {
+	if user.UnsubscribeToken != "" {
+		return user.UnsubscribeToken, nil
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	filter := bson.M{"_id": user.ID, "unsubscribe_token": bson.M{"$exists": false}}
+	if _, err := db.UsersCol.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"unsubscribe_token": hex.EncodeToString(buf)}}); err != nil {
+		return "", err
+	}
+
+	// Another email may have created it first
+	var stored models.User
+	opts := options.FindOne().SetProjection(bson.M{"unsubscribe_token": 1})
+	if err := db.UsersCol.FindOne(ctx, bson.M{"_id": user.ID}, opts).Decode(&stored); err != nil {
+		return "", err
+	}
+	return stored.UnsubscribeToken, nil
+}
+
+// notifyExpenseAdded emails the participants of a new expense, other than the
+// one who paid, their share of it
+func notifyExpenseAdded(expense models.Expense) {
+	if notifier == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := db.UsersCol.Find(ctx, bson.M{"_id": bson.M{"$in": append([]primitive.ObjectID{expense.CreatedBy}, expense.Participants...)}})
+	if err != nil {
+		log.Printf("Failed to fetch participants of expense %s: %v", expense.ID.Hex(), err)
+		return
+	}
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		log.Printf("Failed to fetch participants of expense %s: %v", expense.ID.Hex(), err)
+		return
+	}
+	payerName := ""
+	for _, u := range users {
+		if u.ID == expense.CreatedBy {
+			payerName = u.Name
+		}
+	}
+
+	currency := utils.NormalizeCurrency(expense.Currency)
+	for _, u := range users {
+		if u.ID == expense.CreatedBy || !wantsEmail(u, emailExpenseAdded) {
+			continue
+		}
+		data := expenseAddedEmail{
+			PayerName:   payerName,
+			Description: expense.Description,
+			Total:       emailAmount{utils.FormatAmount(expense.Amount, currency), currency},
+			Date:        expense.Day().Format("2 Jan 2006"),
+		}
+		if share, ok := splitAmountFor(expense.SplitDetails, userSplitKeys(u)); ok {
+			data.Share = &emailAmount{utils.FormatAmount(share, currency), currency}
+		}
+		if err := deliverEmail(ctx, u, emailExpenseAdded, expenseAddedTemplate, data); err != nil {
+			log.Printf("Failed to send expense_added email to user %s: %v", u.ID.Hex(), err)
+		}
+	}
+}
+
+// StartDigestScheduler emails every user who wants it a summary of what they
+// owe, once per digestPeriod, checking for due digests every interval
+func StartDigestScheduler(interval time.Duration) {
+	go func() {
+		sendDueDigests()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sendDueDigests()
+		}
+	}()
+}
+
+// sendDueDigests sends the digests that are due. Users are claimed one at a
+// time so concurrent server instances don't send the same digest twice.
+func sendDueDigests() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), emailTimeout+30*time.Second)
+		user, ok := claimDigest(ctx)
+		if ok {
+			if err := sendDigest(ctx, user); err != nil {
+				log.Printf("Failed to send digest to user %s: %v", user.ID.Hex(), err)
+			}
+		}
+		cancel()
+		if !ok {
+			return
+		}
+	}
+}
+
+// claimDigest marks the next user whose digest is due as sent and returns them.
+// A user's first digest is due one period after they signed up.
+func claimDigest(ctx context.Context) (models.User, bool) {
+	var user models.User
+	now := time.Now()
+	cutoff := now.Add(-digestPeriod)
+	filter := bson.M{
+		"email":                    bson.M{"$gt": ""},
+		"placeholder":              bson.M{"$ne": true},
+		"merged_into":              bson.M{"$exists": false},
+		"email_preferences.digest": bson.M{"$ne": false},
+		"$or": []bson.M{
+			{"last_digest_at": bson.M{"$lte": cutoff}},
+			{"last_digest_at": bson.M{"$exists": false}, "created_at": bson.M{"$lte": cutoff}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"last_digest_at": now}}
+	if err := db.UsersCol.FindOneAndUpdate(ctx, filter, update).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to claim digest: %v", err)
+		}
+		return user, false
+	}
+	return user, true
+}
+
+// sendDigest emails the user what they owe each other user. Nothing is sent when they owe nothing.
+func sendDigest(ctx context.Context, user models.User) error {
+	debts, err := userDebts(ctx, user)
+	if err != nil {
+		return err
+	}
+	ids := []primitive.ObjectID{}
+	for id, amounts := range debts {
+		if len(positiveAmounts(amounts)) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	cursor, err := db.UsersCol.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"name": 1}))
+	if err != nil {
+		return err
+	}
+	creditors := []models.User{}
+	if err := cursor.All(ctx, &creditors); err != nil {
+		return err
+	}
+
+	lines := []digestLine{}
+	for _, creditor := range creditors {
+		lines = append(lines, digestLine{Name: creditor.Name, Amounts: emailAmounts(positiveAmounts(debts[creditor.ID]))})
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Name < lines[j].Name })
+
+	return deliverEmail(ctx, user, emailDigest, digestTemplate, digestEmail{Debts: lines})
+}
+
+// emailAmounts formats amounts for an email, ordered by currency
+func emailAmounts(amounts map[string]float64) []emailAmount {
+	currencies := []string{}
+	for currency := range amounts {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	result := []emailAmount{}
+	for _, currency := range currencies {
+		result = append(result, emailAmount{utils.FormatAmount(amounts[currency], currency), currency})
+	}
+	return result
+}
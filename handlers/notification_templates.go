@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"bytes"
+	"expenses-backend/notify"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// emailTemplate renders an email's subject and its plain text and HTML bodies.
+// Templates are executed with an emailData.
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// emailData is what email templates are executed with; Data is specific to the template
+type emailData struct {
+	Name           string
+	UnsubscribeURL string
+	Data           interface{}
+}
+
+// emailAmount is an amount formatted for its currency
+type emailAmount struct {
+	Amount   string
+	Currency string
+}
+
+type expenseAddedEmail struct {
+	PayerName   string
+	Description string
+	Total       emailAmount
+	Share       *emailAmount
+	Date        string
+}
+
+type reminderEmail struct {
+	CreditorName string
+	Amounts      []emailAmount
+	Note         string
+}
+
+type digestEmail struct {
+	Debts []digestLine
+}
+
+// digestLine is what the digest's recipient owes one other user
+type digestLine struct {
+	Name    string
+	Amounts []emailAmount
+}
+
+func newEmailTemplate(name, subject, text, html string) emailTemplate {
+	return emailTemplate{
+		subject: texttemplate.Must(texttemplate.New(name).Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name).Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name).Parse(html)),
+	}
+}
+
+func (t emailTemplate) render(to string, data emailData) (notify.Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return notify.Message{}, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return notify.Message{}, err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return notify.Message{}, err
+	}
+	return notify.Message{To: to, Subject: subject.String(), Text: text.String(), HTML: html.String()}, nil
+}
+
+const emailTextFooter = `
+--
+You can turn these emails off: {{.UnsubscribeURL}}
+`
+
+const emailHTMLFooter = `<hr>
+<p style="color:#888;font-size:12px">You can <a href="{{.UnsubscribeURL}}">turn these emails off</a>.</p>
+</body></html>`
+
+var expenseAddedTemplate = newEmailTemplate("expense_added",
+	`{{.Data.PayerName}} added you to "{{.Data.Description}}"`,
+	`Hi {{.Name}},
+
+{{.Data.PayerName}} added you to "{{.Data.Description}}" on {{.Data.Date}}.
+Total: {{.Data.Total.Amount}} {{.Data.Total.Currency}}
+{{with .Data.Share}}Your share: {{.Amount}} {{.Currency}}
+{{end}}`+emailTextFooter,
+	`<html><body>
+<p>Hi {{.Name}},</p>
+<p>{{.Data.PayerName}} added you to <strong>{{.Data.Description}}</strong> on {{.Data.Date}}.</p>
+<table>
+<tr><td>Total</td><td>{{.Data.Total.Amount}} {{.Data.Total.Currency}}</td></tr>
+{{with .Data.Share}}<tr><td>Your share</td><td><strong>{{.Amount}} {{.Currency}}</strong></td></tr>{{end}}
+</table>
+`+emailHTMLFooter)
+
+var reminderTemplate = newEmailTemplate("reminder",
+	`Reminder from {{.Data.CreditorName}}`,
+	`Hi {{.Name}},
+
+{{.Data.CreditorName}} sent you a reminder that you owe them:
+{{range .Data.Amounts}}  {{.Amount}} {{.Currency}}
+{{end}}{{with .Data.Note}}
+"{{.}}"
+{{end}}`+emailTextFooter,
+	`<html><body>
+<p>Hi {{.Name}},</p>
+<p>{{.Data.CreditorName}} sent you a reminder that you owe them:</p>
+<ul>
+{{range .Data.Amounts}}<li><strong>{{.Amount}} {{.Currency}}</strong></li>
+{{end}}</ul>
+{{with .Data.Note}}<blockquote>{{.}}</blockquote>{{end}}
+`+emailHTMLFooter)
+
+var digestTemplate = newEmailTemplate("digest",
+	`Your weekly balance summary`,
+	`Hi {{.Name}},
+
+Here is what you currently owe:
+{{range .Data.Debts}}
+{{.Name}}: {{range $i, $a := .Amounts}}{{if $i}}, {{end}}{{$a.Amount}} {{$a.Currency}}{{end}}{{end}}
+`+emailTextFooter,
+	`<html><body>
+<p>Hi {{.Name}},</p>
+<p>Here is what you currently owe:</p>
+<table>
+{{range .Data.Debts}}<tr><td>{{.Name}}</td><td>{{range $i, $a := .Amounts}}{{if $i}}, {{end}}<strong>{{$a.Amount}} {{$a.Currency}}</strong>{{end}}</td></tr>
+{{end}}</table>
+`+emailHTMLFooter)
+
+// unsubscribePage is shown by the unsubscribe link. With an Action it asks for
+// confirmation; otherwise it shows the Message.
+type unsubscribePage struct {
+	Email   string
+	Kind    string
+	Action  string
+	Message string
+}
+
+var unsubscribePageTemplate = htmltemplate.Must(htmltemplate.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body style="font-family:sans-serif;max-width:480px;margin:48px auto">
+{{if .Action}}<p>Stop sending {{.Kind}} to <strong>{{.Email}}</strong>?</p>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button type="submit">Unsubscribe</button>
+</form>
+{{else}}<p>{{.Message}}</p>
+{{end}}</body></html>`))
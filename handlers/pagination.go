@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultPageLimit = 10
+	maxPageLimit     = 100
+)
+
+// errCursorSortMismatch is returned when a cursor is used with a different sort order
+var errCursorSortMismatch = errors.New("cursor does not match the requested sort order")
+
+// Page is the response envelope of paginated list endpoints
+type Page[T any] struct {
+	Data       []T    `json:"data"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+	Total      *int64 `json:"total,omitempty"`
+}
+
+// pageParams holds the parsed 'limit', 'cursor', 'page' and 'include_total' query parameters
+type pageParams struct {
+	Limit        int
+	Cursor       *pageCursor
+	Skip         int
+	IncludeTotal bool
+}
+
+// pageCursor marks the boundary item of a page by its sort key values. It is
+// handed to clients as an opaque base64 token.
+type pageCursor struct {
+	// Sort is the sort order the cursor was created for
+	Sort string `bson:"s"`
+	// Values are the boundary item's sort field values, ending with _id
+	Values bson.D `bson:"v"`
+	// Backward requests the page before the boundary item
+	Backward bool `bson:"b,omitempty"`
+}
+
+func (pc pageCursor) encode() string {
+	data, err := bson.Marshal(pc)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var pc pageCursor
+	if err := bson.Unmarshal(data, &pc); err != nil || len(pc.Values) == 0 {
+		return nil, errors.New("invalid cursor")
+	}
+	// Sort values are scalars; documents could smuggle query operators into keysetFilter
+	for _, e := range pc.Values {
+		switch e.Value.(type) {
+		case bson.D, bson.M, bson.A, primitive.Regex, primitive.JavaScript, primitive.CodeWithScope:
+			return nil, errors.New("invalid cursor")
+		}
+	}
+	return &pc, nil
+}
+
+// cursorMatchesSort reports whether values have the sort's fields in order,
+// each of the BSON type the field's key values have
+func cursorMatchesSort(values bson.D, sort bson.D, key bson.D) bool {
+	if len(values) != len(sort) || len(key) != len(sort) {
+		return false
+	}
+	for i, e := range sort {
+		if values[i].Key != e.Key {
+			return false
+		}
+		got, _, err := bson.MarshalValue(values[i].Value)
+		if err != nil {
+			return false
+		}
+		want, _, err := bson.MarshalValue(key[i].Value)
+		if err != nil || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePageParams reads the pagination query parameters. 'page' is kept for
+// older clients and is ignored when a cursor is given.
+func parsePageParams(c *gin.Context, maxLimit int) (pageParams, error) {
+	params := pageParams{Limit: defaultPageLimit}
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return params, errors.New("Invalid limit parameter")
+		}
+		params.Limit = limit
+	}
+	if params.Limit > maxLimit {
+		params.Limit = maxLimit
+	}
+
+	if token := c.Query("cursor"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil {
+			return params, err
+		}
+		params.Cursor = cursor
+	} else if pageStr := c.Query("page"); pageStr != "" {
+		page, err := strconv.Atoi(pageStr)
+		if err != nil || page < 1 {
+			return params, errors.New("Invalid page parameter")
+		}
+		params.Skip = (page - 1) * params.Limit
+	}
+
+	params.IncludeTotal = c.Query("include_total") == "true"
+	return params, nil
+}
+
+// sortSignature identifies a sort order so cursors cannot be reused with another one
+func sortSignature(sort bson.D) string {
+	sig := ""
+	for _, e := range sort {
+		sig += e.Key + ":" + strconv.Itoa(e.Value.(int)) + ","
+	}
+	return sig
+}
+
+// keysetFilter matches the items after (or, going backward, before) the cursor's
+// boundary item in the given sort order
+func keysetFilter(sort bson.D, values bson.D, backward bool) bson.M {
+	clauses := []bson.M{}
+	for i, e := range sort {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[sort[j].Key] = values[j].Value
+		}
+		op := "$gt"
+		if (e.Value.(int) < 0) != backward {
+			op = "$lt"
+		}
+		clause[e.Key] = bson.M{op: values[i].Value}
+		clauses = append(clauses, clause)
+	}
+	return bson.M{"$or": clauses}
+}
+
+// findPage fetches one page of documents matching filter in the given sort
+// order, which must end with _id. keyOf returns an item's values for the sort fields.
+func findPage[T any](ctx context.Context, col *mongo.Collection, filter bson.M, sort bson.D, params pageParams, keyOf func(T) bson.D) (Page[T], error) {
+	page := Page[T]{Data: []T{}}
+	signature := sortSignature(sort)
+
+	if params.IncludeTotal {
+		total, err := col.CountDocuments(ctx, filter)
+		if err != nil {
+			return page, err
+		}
+		page.Total = &total
+	}
+
+	query := filter
+	backward := false
+	findSort := sort
+	if params.Cursor != nil {
+		var zero T
+		if params.Cursor.Sort != signature || !cursorMatchesSort(params.Cursor.Values, sort, keyOf(zero)) {
+			return page, errCursorSortMismatch
+		}
+		backward = params.Cursor.Backward
+		query = bson.M{"$and": []bson.M{filter, keysetFilter(sort, params.Cursor.Values, backward)}}
+		if backward {
+			// Walk backward from the boundary, then restore the requested order below
+			findSort = bson.D{}
+			for _, e := range sort {
+				findSort = append(findSort, bson.E{Key: e.Key, Value: -e.Value.(int)})
+			}
+		}
+	}
+
+	// Fetch one extra item to know whether another page follows
+	findOptions := options.Find().SetSort(findSort).SetLimit(int64(params.Limit + 1))
+	if params.Skip > 0 {
+		findOptions.SetSkip(int64(params.Skip))
+	}
+	cursor, err := col.Find(ctx, query, findOptions)
+	if err != nil {
+		return page, err
+	}
+	if err := cursor.All(ctx, &page.Data); err != nil {
+		return page, err
+	}
+
+	hasMore := len(page.Data) > params.Limit
+	if hasMore {
+		page.Data = page.Data[:params.Limit]
+	}
+	if backward {
+		for i, j := 0, len(page.Data)-1; i < j; i, j = i+1, j-1 {
+			page.Data[i], page.Data[j] = page.Data[j], page.Data[i]
+		}
+	}
+	if len(page.Data) == 0 {
+		return page, nil
+	}
+
+	first, last := page.Data[0], page.Data[len(page.Data)-1]
+	morePrev := params.Skip > 0 || (params.Cursor != nil && !backward) || (backward && hasMore)
+	moreNext := (!backward && hasMore) || backward
+	if moreNext {
+		page.NextCursor = pageCursor{Sort: signature, Values: keyOf(last)}.encode()
+	}
+	if morePrev {
+		page.PrevCursor = pageCursor{Sort: signature, Values: keyOf(first), Backward: true}.encode()
+	}
+	return page, nil
+}
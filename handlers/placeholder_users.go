@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// participantResolver identifies the participants of an expense. Unknown emails
+// and mobile numbers become placeholder users when allowed, but these are only
+// planned here; insertPlaceholders writes them once the whole expense is valid.
+type participantResolver struct {
+	createPlaceholders bool
+	users              map[string]models.User
+	placeholders       []models.User
+}
+
+func newParticipantResolver(createPlaceholders bool) *participantResolver {
+	return &participantResolver{createPlaceholders: createPlaceholders, users: map[string]models.User{}}
+}
+
+// identify identifies a participant, planning an unclaimed placeholder user when
+// allowed and the identifier is an unknown email or mobile number. The same
+// identifier always resolves to the same user, placeholder or not.
+func (r *participantResolver) identify(identifier string) (models.User, error) {
+	identifier = strings.TrimSpace(identifier)
+	key := identifier
+	if emailRegex.MatchString(identifier) {
+		key = strings.ToLower(identifier)
+	}
+	if user, ok := r.users[key]; ok {
+		return user, nil
+	}
+
+	user, err := identifyUser(identifier)
+	if err == nil {
+		r.users[key] = user
+		return user, nil
+	}
+	if !r.createPlaceholders || !errors.Is(err, errUserNotFound) {
+		return user, err
+	}
+
+	placeholder := models.User{
+		ID:          primitive.NewObjectID(),
+		Placeholder: true,
+		CreatedAt:   time.Now(),
+	}
+	switch {
+	case emailRegex.MatchString(identifier):
+		placeholder.Email = key
+		placeholder.Name = key[:strings.Index(key, "@")]
+	case phoneRegex.MatchString(identifier):
+		placeholder.MobileNumber = identifier
+		placeholder.Name = identifier
+	default:
+		// Names alone are not enough to later match a signup to the placeholder
+		return user, err
+	}
+
+	r.users[key] = placeholder
+	r.placeholders = append(r.placeholders, placeholder)
+	return placeholder, nil
+}
+
+// errTransactionsUnsupported is returned for work that needs a transaction on a standalone MongoDB
+var errTransactionsUnsupported = errors.New("this requires MongoDB to run as a replica set")
+
+// isTransactionUnsupported reports whether err comes from starting a transaction
+// on a standalone MongoDB
+func isTransactionUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(illegalOperationCode) &&
+		strings.Contains(err.Error(), "Transaction numbers are only allowed")
+}
+
+// illegalOperationCode is MongoDB's error code for, among others, transactions on a standalone server
+const illegalOperationCode = 20
+
+// withPlaceholders runs insert, first creating the planned placeholder users in
+// the same transaction when there are any. A standalone MongoDB has no
+// transactions; there a failed insert leaves the placeholders behind.
+func (r *participantResolver) withPlaceholders(ctx context.Context, expense *models.Expense, insert func(ctx context.Context) error) error {
+	if len(r.placeholders) == 0 {
+		return insert(ctx)
+	}
+
+	session, err := db.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := r.insertPlaceholders(sc, expense); err != nil {
+			return nil, err
+		}
+		return nil, insert(sc)
+	})
+	if isTransactionUnsupported(err) {
+		if err := r.insertPlaceholders(ctx, expense); err != nil {
+			return err
+		}
+		return insert(ctx)
+	}
+	return err
+}
+
+// insertPlaceholders creates the planned placeholder users. Where a user with the
+// same email or mobile number was created meanwhile, that user takes the
+// placeholder's place in the expense. It should run in the transaction that
+// inserts the expense.
+func (r *participantResolver) insertPlaceholders(ctx context.Context, expense *models.Expense) error {
+	for _, placeholder := range r.placeholders {
+		filter := bson.M{"email": placeholder.Email}
+		identifier := placeholder.Email
+		if placeholder.Email == "" {
+			filter = bson.M{"mobile_number": placeholder.MobileNumber}
+			identifier = placeholder.MobileNumber
+		}
+
+		// Upsert rather than insert: a duplicate key error would abort the transaction
+		var user models.User
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		if err := db.UsersCol.FindOneAndUpdate(ctx, filter, bson.M{"$setOnInsert": placeholder}, opts).Decode(&user); err != nil {
+			return err
+		}
+		if user.ID == placeholder.ID {
+			continue
+		}
+
+		// Created concurrently by another request; follow it in case it was merged since
+		existing, err := identifyUser(identifier)
+		if err != nil {
+			existing = user
+		}
+		expense.Participants = replaceParticipant(expense.Participants, placeholder.ID, existing.ID)
+		expense.SplitDetails = mergeSplitDetails(expense.SplitDetails, []string{placeholder.ID.Hex()}, existing.ID.Hex())
+		for key, u := range r.users {
+			if u.ID == placeholder.ID {
+				r.users[key] = existing
+			}
+		}
+	}
+	return nil
+}
+
+// findPlaceholders returns the unclaimed placeholders matching a signup's email or mobile number
+func findPlaceholders(ctx context.Context, email, mobileNumber string) ([]models.User, error) {
+	filter := bson.M{
+		"placeholder": true,
+		"merged_into": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"email": email},
+			{"mobile_number": mobileNumber},
+		},
+	}
+	cursor, err := db.UsersCol.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	placeholders := []models.User{}
+	if err := cursor.All(ctx, &placeholders); err != nil {
+		return nil, err
+	}
+	return placeholders, nil
+}
+
+// claimPlaceholders turns the first placeholder into the signed-up user so its
+// expenses carry over, folding a second placeholder (one matched by email, the
+// other by mobile number) into it first
+func claimPlaceholders(ctx context.Context, user models.User, placeholders []models.User) (models.User, error) {
+	claimed := placeholders[0]
+
+	claim := func(ctx context.Context) (models.User, error) {
+		var result models.User
+		set := bson.M{
+			"name":          user.Name,
+			"email":         user.Email,
+			"mobile_number": user.MobileNumber,
+			"claimed_at":    user.CreatedAt,
+			"updated_at":    user.CreatedAt,
+		}
+		if user.UPIVPA != "" {
+			set["upi_vpa"] = user.UPIVPA
+		}
+		update := bson.M{"$set": set, "$unset": bson.M{"placeholder": ""}}
+		findOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := db.UsersCol.FindOneAndUpdate(ctx, bson.M{"_id": claimed.ID}, update, findOptions).Decode(&result)
+		return result, err
+	}
+
+	if len(placeholders) == 1 {
+		return claim(ctx)
+	}
+
+	session, err := db.Client.StartSession()
+	if err != nil {
+		return models.User{}, err
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		for _, other := range placeholders[1:] {
+			var updated int
+			if _, err := mergeUsers(sc, other.ID, claimed.ID, &updated); err != nil {
+				return nil, err
+			}
+			// Release the tombstone's identifiers so the claimed user can take them
+			_, err := db.UsersCol.UpdateOne(sc, bson.M{"_id": other.ID}, bson.M{
+				"$unset": bson.M{"email": "", "mobile_number": ""},
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return claim(sc)
+	})
+	if isTransactionUnsupported(err) {
+		return models.User{}, errTransactionsUnsupported
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	return result.(models.User), nil
+}
@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RecurringExpenseInput is an expense template plus the schedule it repeats on.
+// The expense_date of the template is set by the schedule.
+type RecurringExpenseInput struct {
+	ExpenseInput
+	Schedule ScheduleInput `json:"schedule" binding:"required"`
+}
+
+// ScheduleInput describes when a recurring expense repeats. Timezone is taken from the template.
+type ScheduleInput struct {
+	Frequency string `json:"frequency" binding:"required,oneof=weekly monthly yearly"`
+	// Interval repeats every N weeks, months or years; defaults to 1
+	Interval int `json:"interval,omitempty"`
+	// Weekday (0 = Sunday) defaults to the start date's weekday for weekly schedules
+	Weekday *int `json:"weekday,omitempty"`
+	// MonthDay defaults to the start date's day for monthly and yearly schedules
+	MonthDay int `json:"month_day,omitempty"`
+	// Month defaults to the start date's month for yearly schedules
+	Month int `json:"month,omitempty"`
+	// StartDate and EndDate are YYYY-MM-DD; StartDate defaults to today
+	StartDate string `json:"start_date,omitempty"`
+	EndDate   string `json:"end_date,omitempty"`
+	Count     int    `json:"count,omitempty"`
+}
+
+// CreateRecurringExpense handles creating a recurring expense
+func CreateRecurringExpense(c *gin.Context) {
+	var input RecurringExpenseInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := expenseValidate.Struct(input.ExpenseInput); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(input.ExpenseDate) != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expense_date is set by the schedule, use schedule.start_date"})
+		return
+	}
+
+	schedule, err := parseSchedule(input.Schedule, strings.TrimSpace(input.Timezone))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	nextRun := scheduleNextRun(schedule, 0)
+	if nextRun == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Schedule has no occurrences"})
+		return
+	}
+
+	// Validate the template the same way AddExpense would on its first occurrence
+	input.ExpenseDate = nextRun.In(scheduleLocation(schedule)).Format("2006-01-02")
+	participants := newParticipantResolver(input.CreatePlaceholders)
+	expense, _, reqErr := buildExpense(input.ExpenseInput, participants)
+	if reqErr != nil {
+		c.JSON(reqErr.Status, reqErr.Body)
+		return
+	}
+
+	template, err := recurringTemplate(input.ExpenseInput, expense, participants)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid participant identifier: ", err))
+		return
+	}
+
+	now := time.Now()
+	recurring := models.RecurringExpense{
+		Template:  template,
+		Schedule:  schedule,
+		CreatedBy: expense.CreatedBy,
+		NextRun:   nextRun,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Placeholder participants are created along with the recurring expense
+	err = participants.withPlaceholders(ctx, &expense, func(ctx context.Context) error {
+		// A placeholder may have given way to a user created meanwhile
+		template, err := recurringTemplate(input.ExpenseInput, expense, participants)
+		if err != nil {
+			return err
+		}
+		recurring.Template = template
+		recurring.ID = primitive.NewObjectID()
+		_, err = db.RecurringCol.InsertOne(ctx, recurring)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recurring expense"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, recurring)
+}
+
+// GetRecurringExpenses handles listing recurring expenses, optionally only those
+// created by or shared with the user given by the 'identifier' query parameter
+func GetRecurringExpenses(c *gin.Context) {
+	filter := bson.M{}
+	if identifier := c.Query("identifier"); identifier != "" {
+		user, err := identifyUser(identifier)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+			return
+		}
+		filter["$or"] = []bson.M{
+			{"created_by": user.ID},
+			{"template.participants": user.ID.Hex()},
+		}
+	}
+
+	params, err := parsePageParams(c, maxPageLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	page, err := findPage(ctx, db.RecurringCol, filter, sort, params, func(r models.RecurringExpense) bson.D {
+		return bson.D{{Key: "created_at", Value: r.CreatedAt}, {Key: "_id", Value: r.ID}}
+	})
+	if err != nil {
+		if errors.Is(err, errCursorSortMismatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve recurring expenses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// GetRecurringExpense handles fetching one recurring expense
+func GetRecurringExpense(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	recurring, ok := findRecurringExpense(ctx, c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, recurring)
+}
+
+// PauseRecurringExpense handles stopping a recurring expense from creating expenses until resumed
+func PauseRecurringExpense(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	recurring, ok := findRecurringExpense(ctx, c)
+	if !ok {
+		return
+	}
+	updateRecurringExpense(ctx, c, recurring, bson.M{"$set": bson.M{"paused": true, "updated_at": time.Now()}})
+}
+
+// ResumeRecurringExpense handles resuming a paused recurring expense. Occurrences
+// that fell due while it was paused are skipped rather than created late.
+func ResumeRecurringExpense(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	recurring, ok := findRecurringExpense(ctx, c)
+	if !ok {
+		return
+	}
+	if !recurring.Paused {
+		c.JSON(http.StatusOK, recurring)
+		return
+	}
+
+	loc := scheduleLocation(recurring.Schedule)
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	next, nextRun := recurring.NextIndex, recurring.NextRun
+	for nextRun != nil && nextRun.Before(today) {
+		next++
+		nextRun = scheduleNextRun(recurring.Schedule, next)
+	}
+
+	updateRecurringExpense(ctx, c, recurring, bson.M{
+		"$set":   bson.M{"paused": false, "next_index": next, "next_run": nextRun, "updated_at": time.Now()},
+		"$unset": bson.M{"last_error": ""},
+	})
+}
+
+// SkipRecurringExpense handles skipping the next occurrence of a recurring expense
+func SkipRecurringExpense(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	recurring, ok := findRecurringExpense(ctx, c)
+	if !ok {
+		return
+	}
+	if recurring.NextRun == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Recurring expense has no more occurrences"})
+		return
+	}
+
+	next := recurring.NextIndex + 1
+	updateRecurringExpense(ctx, c, recurring, bson.M{
+		"$set":  bson.M{"next_index": next, "next_run": scheduleNextRun(recurring.Schedule, next), "updated_at": time.Now()},
+		"$push": bson.M{"skipped": *recurring.NextRun},
+	})
+}
+
+// DeleteRecurringExpense handles stopping a recurring expense for good. Expenses
+// it already created are kept.
+func DeleteRecurringExpense(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recurring expense id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.RecurringCol.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete recurring expense"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recurring expense not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// findRecurringExpense loads the recurring expense given by :id. On failure it
+// writes the error response and returns false.
+func findRecurringExpense(ctx context.Context, c *gin.Context) (models.RecurringExpense, bool) {
+	var recurring models.RecurringExpense
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recurring expense id"})
+		return recurring, false
+	}
+	if err := db.RecurringCol.FindOne(ctx, bson.M{"_id": id}).Decode(&recurring); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recurring expense not found"})
+			return recurring, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch recurring expense"})
+		return recurring, false
+	}
+	return recurring, true
+}
+
+// updateRecurringExpense applies update to recurring unless the scheduler
+// advanced it since it was read, and responds with the updated document
+func updateRecurringExpense(ctx context.Context, c *gin.Context, recurring models.RecurringExpense, update bson.M) {
+	filter := bson.M{"_id": recurring.ID, "next_index": recurring.NextIndex}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated models.RecurringExpense
+	if err := db.RecurringCol.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusConflict, gin.H{"error": "Recurring expense was updated concurrently, try again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update recurring expense"})
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// parseSchedule validates a schedule and fills in its defaults from the start date
+func parseSchedule(input ScheduleInput, timezone string) (models.Schedule, error) {
+	loc := time.UTC
+	if timezone != "" {
+		l, err := time.LoadLocation(timezone)
+		if err != nil {
+			return models.Schedule{}, errors.New("Unknown timezone '" + timezone + "'")
+		}
+		loc = l
+	}
+
+	schedule := models.Schedule{
+		Frequency: input.Frequency,
+		Interval:  input.Interval,
+		Count:     input.Count,
+		Timezone:  timezone,
+	}
+	if schedule.Interval == 0 {
+		schedule.Interval = 1
+	}
+	if schedule.Interval < 0 {
+		return schedule, errors.New("schedule.interval must be positive")
+	}
+	if schedule.Count < 0 {
+		return schedule, errors.New("schedule.count must not be negative")
+	}
+
+	now := time.Now().In(loc)
+	schedule.StartDate = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if input.StartDate != "" {
+		start, err := time.ParseInLocation("2006-01-02", input.StartDate, loc)
+		if err != nil {
+			return schedule, errors.New("schedule.start_date must be YYYY-MM-DD")
+		}
+		schedule.StartDate = start
+	}
+	if input.EndDate != "" {
+		end, err := time.ParseInLocation("2006-01-02", input.EndDate, loc)
+		if err != nil {
+			return schedule, errors.New("schedule.end_date must be YYYY-MM-DD")
+		}
+		if end.Before(schedule.StartDate) {
+			return schedule, errors.New("schedule.end_date is before start_date")
+		}
+		schedule.EndDate = &end
+	}
+
+	switch schedule.Frequency {
+	case "weekly":
+		weekday := int(schedule.StartDate.Weekday())
+		if input.Weekday != nil {
+			weekday = *input.Weekday
+		}
+		if weekday < 0 || weekday > 6 {
+			return schedule, errors.New("schedule.weekday must be 0 (Sunday) to 6 (Saturday)")
+		}
+		schedule.Weekday = &weekday
+	case "monthly", "yearly":
+		schedule.MonthDay = input.MonthDay
+		if schedule.MonthDay == 0 {
+			schedule.MonthDay = schedule.StartDate.Day()
+		}
+		if schedule.MonthDay < 1 || schedule.MonthDay > 31 {
+			return schedule, errors.New("schedule.month_day must be 1 to 31")
+		}
+		if schedule.Frequency == "yearly" {
+			schedule.Month = input.Month
+			if schedule.Month == 0 {
+				schedule.Month = int(schedule.StartDate.Month())
+			}
+			if schedule.Month < 1 || schedule.Month > 12 {
+				return schedule, errors.New("schedule.month must be 1 to 12")
+			}
+		}
+	}
+
+	return schedule, nil
+}
+
+// recurringTemplate turns a validated input into a template that refers to
+// users by ID, using the expense and participants buildExpense made from it
+func recurringTemplate(input ExpenseInput, expense models.Expense, participants *participantResolver) (models.ExpenseTemplate, error) {
+	template := models.ExpenseTemplate{
+		Description:  expense.Description,
+		Amount:       expense.Amount,
+		Currency:     expense.Currency,
+		Tags:         expense.Tags,
+		CreatedBy:    expense.CreatedBy.Hex(),
+		SplitType:    expense.SplitType,
+		Participants: []string{},
+	}
+	// Keep suggesting a category per occurrence unless one was chosen
+	if expense.CategorySource == CategorySourceUser {
+		template.Category = expense.Category
+	}
+	for _, p := range expense.Participants {
+		template.Participants = append(template.Participants, p.Hex())
+	}
+
+	// Percentages must stay percentages, so re-key the input rather than copying the computed split
+	if expense.SplitType != "Equal" {
+		template.SplitDetails = make(map[string]interface{}, len(input.SplitDetails))
+		for k, v := range input.SplitDetails {
+			user, err := participants.identify(k)
+			if err != nil {
+				return template, err
+			}
+			template.SplitDetails[user.ID.Hex()] = v
+		}
+	}
+	return template, nil
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxCatchUpOccurrences bounds how many missed occurrences of one recurring
+// expense a single scheduler run creates, e.g. after a long downtime
+const maxCatchUpOccurrences = 100
+
+// StartRecurringScheduler creates the expenses of due recurring expenses now
+// and then every interval, in the background
+func StartRecurringScheduler(interval time.Duration) {
+	go func() {
+		runDueRecurringExpenses()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runDueRecurringExpenses()
+		}
+	}()
+}
+
+// runDueRecurringExpenses creates an expense for every occurrence that is due,
+// including ones missed while the server was down
+func runDueRecurringExpenses() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	now := time.Now()
+	cursor, err := db.RecurringCol.Find(ctx, bson.M{"paused": false, "next_run": bson.M{"$lte": now}})
+	if err != nil {
+		log.Printf("Failed to fetch due recurring expenses: %v", err)
+		return
+	}
+	due := []models.RecurringExpense{}
+	if err := cursor.All(ctx, &due); err != nil {
+		log.Printf("Failed to fetch due recurring expenses: %v", err)
+		return
+	}
+
+	for i := range due {
+		r := &due[i]
+		for n := 0; n < maxCatchUpOccurrences && r.NextRun != nil && !r.NextRun.After(now); n++ {
+			advanced, err := runOccurrence(ctx, r)
+			if err != nil {
+				log.Printf("Failed to create occurrence %d of recurring expense %s: %v", r.NextIndex, r.ID.Hex(), err)
+			}
+			if !advanced {
+				break
+			}
+		}
+	}
+}
+
+// runOccurrence creates the expense for r's next occurrence and advances r past
+// it. The unique (recurring_id, expense_date) index makes it safe to repeat an
+// occurrence whose expense was inserted before a crash. It reports false when r
+// was not advanced, either on error or because it was changed concurrently.
+func runOccurrence(ctx context.Context, r *models.RecurringExpense) (bool, error) {
+	occurrence := *r.NextRun
+	current := bson.M{"_id": r.ID, "next_index": r.NextIndex}
+
+	expense, _, reqErr := buildExpense(recurringExpenseInput(*r, occurrence), newParticipantResolver(false))
+	if reqErr != nil {
+		update := bson.M{"last_error": reqErr.Error(), "updated_at": time.Now()}
+		if reqErr.Status < 500 {
+			// The template no longer builds a valid expense and won't fix itself
+			update["paused"] = true
+		}
+		if _, err := db.RecurringCol.UpdateOne(ctx, current, bson.M{"$set": update}); err != nil {
+			log.Printf("Failed to record error of recurring expense %s: %v", r.ID.Hex(), err)
+		}
+		return false, reqErr
+	}
+	expense.RecurringID = &r.ID
+
+	result, err := db.ExpensesCol.InsertOne(ctx, expense)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		if _, updateErr := db.RecurringCol.UpdateOne(ctx, current, bson.M{"$set": bson.M{"last_error": "Failed to create expense", "updated_at": time.Now()}}); updateErr != nil {
+			log.Printf("Failed to record error of recurring expense %s: %v", r.ID.Hex(), updateErr)
+		}
+		return false, err
+	}
+	if err == nil {
+		expense.ID = result.InsertedID.(primitive.ObjectID)
+		recordEvent(expenseEvent(models.EventExpenseCreated, expense, &expense.CreatedBy, bson.M{"recurring_id": r.ID}))
+		go notifyExpenseAdded(expense)
+		go evaluateBudgets(expense)
+	}
+
+	now := time.Now()
+	next := r.NextIndex + 1
+	nextRun := scheduleNextRun(r.Schedule, next)
+	advanced, err := db.RecurringCol.UpdateOne(ctx, current, bson.M{
+		"$set": bson.M{
+			"next_index":  next,
+			"next_run":    nextRun,
+			"last_run_at": now,
+			"updated_at":  now,
+		},
+		"$unset": bson.M{"last_error": ""},
+	})
+	if err != nil {
+		return false, err
+	}
+	if advanced.MatchedCount == 0 {
+		// Skipped, resumed or deleted meanwhile; the next run picks up its new state
+		return false, nil
+	}
+
+	r.NextIndex, r.NextRun, r.LastRunAt = next, nextRun, &now
+	return true, nil
+}
+
+// recurringExpenseInput builds the AddExpense input for the occurrence of r on the given date
+func recurringExpenseInput(r models.RecurringExpense, occurrence time.Time) ExpenseInput {
+	t := r.Template
+	splitDetails := make(map[string]interface{}, len(t.SplitDetails))
+	for k, v := range t.SplitDetails {
+		splitDetails[k] = v
+	}
+	return ExpenseInput{
+		Description:  t.Description,
+		Amount:       t.Amount,
+		Currency:     t.Currency,
+		Category:     t.Category,
+		Tags:         append([]string{}, t.Tags...),
+		ExpenseDate:  occurrence.In(scheduleLocation(r.Schedule)).Format("2006-01-02"),
+		Timezone:     r.Schedule.Timezone,
+		CreatedBy:    t.CreatedBy,
+		SplitType:    t.SplitType,
+		Participants: append([]string{}, t.Participants...),
+		SplitDetails: splitDetails,
+	}
+}
+
+// scheduleNextRun returns the date of occurrence i, or nil if the schedule ends before it
+func scheduleNextRun(s models.Schedule, i int) *time.Time {
+	if s.Count > 0 && i >= s.Count {
+		return nil
+	}
+	occurrence := scheduleOccurrence(s, i)
+	if s.EndDate != nil && occurrence.After(*s.EndDate) {
+		return nil
+	}
+	return &occurrence
+}
+
+// scheduleOccurrence returns midnight, in the schedule's timezone, of the
+// zero-based occurrence i on or after the start date
+func scheduleOccurrence(s models.Schedule, i int) time.Time {
+	loc := scheduleLocation(s)
+	start := s.StartDate.In(loc)
+	switch s.Frequency {
+	case "weekly":
+		offset := 0
+		if s.Weekday != nil {
+			offset = (*s.Weekday - int(start.Weekday()) + 7) % 7
+		}
+		return time.Date(start.Year(), start.Month(), start.Day()+offset+7*s.Interval*i, 0, 0, 0, 0, loc)
+	case "monthly":
+		month := start.Month()
+		if clampedDate(start.Year(), month, s.MonthDay, loc).Before(start) {
+			month++
+		}
+		return clampedDate(start.Year(), month+time.Month(s.Interval*i), s.MonthDay, loc)
+	default: // yearly
+		year := start.Year()
+		if clampedDate(year, time.Month(s.Month), s.MonthDay, loc).Before(start) {
+			year++
+		}
+		return clampedDate(year+s.Interval*i, time.Month(s.Month), s.MonthDay, loc)
+	}
+}
+
+// clampedDate returns midnight of the given day, or of the month's last day if
+// it is shorter, so "monthly on the 31st" falls on the 30th in April
+func clampedDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, loc)
+}
+
+func scheduleLocation(s models.Schedule) *time.Location {
+	if loc, err := time.LoadLocation(s.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// reminderCooldown is how long a creditor must wait before reminding the same debtor again
+	reminderCooldown      = 24 * time.Hour
+	maxReminderNoteLength = 500
+)
+
+// ReminderInput is the body of a creditor nudging a debtor to pay them back
+type ReminderInput struct {
+	Creditor string `json:"creditor" binding:"required"`
+	Debtor   string `json:"debtor" binding:"required"`
+	// Currency limits the reminder to what is owed in one currency
+	Currency string `json:"currency,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+// SendReminder handles a creditor reminding a debtor of what they owe. The
+// reminder is emailed when the debtor accepts reminders and shows up in both
+// users' activity feeds either way.
+func SendReminder(c *gin.Context) {
+	var input ReminderInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currency := utils.NormalizeCurrency(input.Currency)
+	if _, ok := utils.MinorUnits(currency); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency '" + currency + "'"})
+		return
+	}
+	note := strings.TrimSpace(input.Note)
+	if utf8.RuneCountInString(note) > maxReminderNoteLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Note may be at most " + strconv.Itoa(maxReminderNoteLength) + " characters"})
+		return
+	}
+
+	creditor, err := identifyUser(input.Creditor)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid 'creditor' identifier: ", err))
+		return
+	}
+	debtor, err := identifyUser(input.Debtor)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid 'debtor' identifier: ", err))
+		return
+	}
+	if creditor.ID == debtor.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Creditor and debtor must be different users"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	debts, err := userDebts(ctx, debtor)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate balances"})
+		return
+	}
+	owed := positiveAmounts(debts[creditor.ID])
+	if input.Currency != "" {
+		owed = map[string]float64{currency: owed[currency]}
+		owed = positiveAmounts(owed)
+	}
+	if len(owed) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": debtor.Name + " doesn't owe " + creditor.Name + " anything"})
+		return
+	}
+
+	// Claim the cooldown before emailing, so concurrent reminders can't both send
+	now := time.Now()
+	sentAt := "reminders_sent_at." + debtor.ID.Hex()
+	result, err := db.UsersCol.UpdateOne(ctx,
+		bson.M{"_id": creditor.ID, sentAt: bson.M{"$not": bson.M{"$gt": now.Add(-reminderCooldown)}}},
+		bson.M{"$set": bson.M{sentAt: now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check earlier reminders"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "A reminder was already sent to " + debtor.Name + " in the last 24 hours"})
+		return
+	}
+
+	emailed := sendEmail(debtor, emailReminders, reminderTemplate, reminderEmail{
+		CreditorName: creditor.Name,
+		Amounts:      emailAmounts(owed),
+		Note:         note,
+	})
+
+	data := bson.M{"creditor": creditor.ID, "debtor": debtor.ID, "amounts": owed, "emailed": emailed}
+	if note != "" {
+		data["note"] = note
+	}
+	recordEvent(models.Event{
+		Type:  models.EventReminderSent,
+		Actor: &creditor.ID,
+		Users: []primitive.ObjectID{creditor.ID, debtor.ID},
+		Data:  data,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"creditor": creditor.ID,
+		"debtor":   debtor.ID,
+		"amounts":  owed,
+		"emailed":  emailed,
+	})
+}
@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/utils"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// reportDimensions are the values accepted by the 'group_by' query parameter, in CSV column order
+var reportDimensions = []string{"month", "week", "category", "payer", "participant"}
+
+const (
+	// reportBasisPaid totals the amounts of expenses, attributed to whoever paid
+	reportBasisPaid = "paid"
+	// reportBasisShare totals the participants' split shares of expenses
+	reportBasisShare = "share"
+)
+
+// ReportUser identifies a payer or participant in a report. Split shares
+// recorded under an email without an account only have the email.
+type ReportUser struct {
+	ID    *primitive.ObjectID `json:"id,omitempty"`
+	Name  string              `json:"name,omitempty"`
+	Email string              `json:"email,omitempty"`
+}
+
+// ReportRow is the total of one group of a spending report in one currency
+type ReportRow struct {
+	Month       string      `json:"month,omitempty"`
+	Week        string      `json:"week,omitempty"`
+	Category    string      `json:"category,omitempty"`
+	Payer       *ReportUser `json:"payer,omitempty"`
+	Participant *ReportUser `json:"participant,omitempty"`
+	Currency    string      `json:"currency"`
+	Total       float64     `json:"total"`
+	Count       int         `json:"count"`
+}
+
+// SpendingReport holds spending totals grouped by the requested dimensions and
+// currency, with overall totals per currency
+type SpendingReport struct {
+	Basis    string      `json:"basis"`
+	GroupBy  []string    `json:"group_by"`
+	Timezone string      `json:"timezone"`
+	Rows     []ReportRow `json:"rows"`
+	Totals   []ReportRow `json:"totals"`
+}
+
+// GetSpendingReport handles totalling spending grouped by month, week,
+// category, payer and/or participant. It accepts the filters of expense
+// listings plus 'group_by', 'basis' (paid or share), 'identifier',
+// 'timezone' and 'format' (json or csv).
+func GetSpendingReport(c *gin.Context) {
+	basis := c.DefaultQuery("basis", reportBasisPaid)
+	if basis != reportBasisPaid && basis != reportBasisShare {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "basis must be paid or share"})
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	groupBy, err := parseReportGroupBy(c.DefaultQuery("group_by", "month"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if containsString(groupBy, "participant") && basis != reportBasisShare {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Grouping by participant requires basis=share"})
+		return
+	}
+
+	timezone := c.DefaultQuery("timezone", "UTC")
+	if _, err := time.LoadLocation(timezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone '" + timezone + "'"})
+		return
+	}
+
+	filter, err := parseExpenseFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("", err))
+		return
+	}
+
+	// With an identifier the report covers what that user paid, or their shares
+	var keys []string
+	if identifier := c.Query("identifier"); identifier != "" {
+		user, err := identifyUser(identifier)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+			return
+		}
+		own := bson.M{"created_by": user.ID}
+		if basis == reportBasisShare {
+			own = bson.M{"participants": user.ID}
+			keys = userSplitKeys(user)
+		}
+		filter = bson.M{"$and": []bson.M{filter, own}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := spendingReportRows(ctx, filter, basis, groupBy, timezone, keys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate report"})
+		return
+	}
+
+	report := SpendingReport{
+		Basis:    basis,
+		GroupBy:  groupBy,
+		Timezone: timezone,
+		Rows:     rows,
+		Totals:   reportTotals(rows),
+	}
+	if format == "csv" {
+		writeReportCSV(c, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// parseReportGroupBy parses a comma-separated 'group_by' query parameter into
+// known dimensions, in the order given
+func parseReportGroupBy(value string) ([]string, error) {
+	groupBy := []string{}
+	for _, dimension := range strings.Split(value, ",") {
+		dimension = strings.ToLower(strings.TrimSpace(dimension))
+		if dimension == "" || containsString(groupBy, dimension) {
+			continue
+		}
+		if !containsString(reportDimensions, dimension) {
+			return nil, fmt.Errorf("cannot group by '%s', use %s", dimension, strings.Join(reportDimensions, ", "))
+		}
+		groupBy = append(groupBy, dimension)
+	}
+	if containsString(groupBy, "month") && containsString(groupBy, "week") {
+		return nil, errors.New("group by either month or week")
+	}
+	return groupBy, nil
+}
+
+// spendingReportRows groups and totals the matching expenses in one
+// aggregation. With the share basis each split share is unwound first and
+// keys, when given, limit it to one user's shares.
+func spendingReportRows(ctx context.Context, filter bson.M, basis string, groupBy []string, timezone string, keys []string) ([]ReportRow, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: filter}}}
+
+	amount := interface{}("$amount")
+	if basis == reportBasisShare {
+		pipeline = append(pipeline,
+			bson.D{{Key: "$addFields", Value: bson.M{"share": bson.M{"$objectToArray": "$split_details"}}}},
+			bson.D{{Key: "$unwind", Value: "$share"}},
+		)
+		if keys != nil {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"$expr": bson.M{"$in": bson.A{bson.M{"$toLower": "$share.k"}, lowerKeys(keys)}}}}})
+		}
+		amount = bson.M{"$toDouble": "$share.v"}
+	}
+
+	id := bson.M{"currency": defaultedField("$currency", utils.DefaultCurrency)}
+	for _, dimension := range groupBy {
+		switch dimension {
+		case "month":
+			id[dimension] = bson.M{"$dateToString": bson.M{"format": "%Y-%m", "date": "$expense_date", "timezone": timezone}}
+		case "week":
+			id[dimension] = bson.M{"$dateToString": bson.M{"format": "%G-W%V", "date": "$expense_date", "timezone": timezone}}
+		case "category":
+			id[dimension] = defaultedField("$category", models.DefaultCategory)
+		case "payer":
+			id[dimension] = "$created_by"
+		case "participant":
+			id[dimension] = bson.M{"$toLower": "$share.k"}
+		}
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$group", Value: bson.M{
+		"_id":   id,
+		"total": bson.M{"$sum": amount},
+		"count": bson.M{"$sum": 1},
+	}}})
+
+	cursor, err := db.ExpensesCol.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ID struct {
+			Currency    string             `bson:"currency"`
+			Month       string             `bson:"month"`
+			Week        string             `bson:"week"`
+			Category    string             `bson:"category"`
+			Payer       primitive.ObjectID `bson:"payer"`
+			Participant string             `bson:"participant"`
+		} `bson:"_id"`
+		Total float64 `bson:"total"`
+		Count int     `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	// Resolve payers and participants to users
+	ids := []primitive.ObjectID{}
+	emails := []string{}
+	for _, g := range groups {
+		if containsString(groupBy, "payer") {
+			ids = append(ids, g.ID.Payer)
+		}
+		if containsString(groupBy, "participant") {
+			if oid, err := primitive.ObjectIDFromHex(g.ID.Participant); err == nil {
+				ids = append(ids, oid)
+			} else {
+				emails = append(emails, g.ID.Participant)
+			}
+		}
+	}
+	users, err := reportUsers(ctx, uniqueIDs(ids), emails)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shares stored under a user's id and under their email end up in the same row
+	merged := map[string]*ReportRow{}
+	rows := []*ReportRow{}
+	for _, g := range groups {
+		row := ReportRow{
+			Month:    g.ID.Month,
+			Week:     g.ID.Week,
+			Category: g.ID.Category,
+			Currency: g.ID.Currency,
+		}
+		if containsString(groupBy, "payer") {
+			row.Payer = users.lookup(g.ID.Payer.Hex())
+		}
+		if containsString(groupBy, "participant") {
+			row.Participant = users.lookup(g.ID.Participant)
+		}
+
+		key := strings.Join([]string{row.Month, row.Week, row.Category, reportUserKey(row.Payer), reportUserKey(row.Participant), row.Currency}, "\x00")
+		if existing, ok := merged[key]; ok {
+			existing.Total += g.Total
+			existing.Count += g.Count
+			continue
+		}
+		row.Total = g.Total
+		row.Count = g.Count
+		merged[key] = &row
+		rows = append(rows, &row)
+	}
+
+	result := make([]ReportRow, 0, len(rows))
+	for _, row := range rows {
+		row.Total = utils.RoundAmount(row.Total, row.Currency)
+		result = append(result, *row)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		for _, pair := range [][2]string{
+			{a.Month, b.Month},
+			{a.Week, b.Week},
+			{a.Category, b.Category},
+			{reportUserName(a.Payer), reportUserName(b.Payer)},
+			{reportUserName(a.Participant), reportUserName(b.Participant)},
+		} {
+			if pair[0] != pair[1] {
+				return pair[0] < pair[1]
+			}
+		}
+		return a.Currency < b.Currency
+	})
+	return result, nil
+}
+
+// reportTotals sums report rows per currency
+func reportTotals(rows []ReportRow) []ReportRow {
+	byCurrency := map[string]*ReportRow{}
+	for _, row := range rows {
+		total, ok := byCurrency[row.Currency]
+		if !ok {
+			total = &ReportRow{Currency: row.Currency}
+			byCurrency[row.Currency] = total
+		}
+		total.Total += row.Total
+		total.Count += row.Count
+	}
+	totals := []ReportRow{}
+	for _, total := range byCurrency {
+		total.Total = utils.RoundAmount(total.Total, total.Currency)
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Currency < totals[j].Currency })
+	return totals
+}
+
+// reportUserIndex finds users by id or by a current or previous email, all lowercased
+type reportUserIndex map[string]*ReportUser
+
+// reportUsers loads the users with the given ids or emails
+func reportUsers(ctx context.Context, ids []primitive.ObjectID, emails []string) (reportUserIndex, error) {
+	index := reportUserIndex{}
+	if len(ids) == 0 && len(emails) == 0 {
+		return index, nil
+	}
+	filter := bson.M{"$or": []bson.M{
+		{"_id": bson.M{"$in": ids}},
+		{"email": bson.M{"$in": emails}},
+		{"previous_emails.value": bson.M{"$in": emails}},
+	}}
+	opts := options.Find().SetProjection(bson.M{"name": 1, "email": 1, "previous_emails": 1})
+	cursor, err := db.UsersCol.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		id := u.ID
+		ru := &ReportUser{ID: &id, Name: u.Name, Email: u.Email}
+		for _, key := range userSplitKeys(u) {
+			if key != "" {
+				index[strings.ToLower(key)] = ru
+			}
+		}
+	}
+	return index, nil
+}
+
+// lookup returns the user for an id or email, or just the key when no user has it
+func (index reportUserIndex) lookup(key string) *ReportUser {
+	if u, ok := index[strings.ToLower(key)]; ok {
+		return u
+	}
+	if oid, err := primitive.ObjectIDFromHex(key); err == nil {
+		return &ReportUser{ID: &oid}
+	}
+	return &ReportUser{Email: key}
+}
+
+func reportUserKey(u *ReportUser) string {
+	if u == nil {
+		return ""
+	}
+	if u.ID != nil {
+		return u.ID.Hex()
+	}
+	return u.Email
+}
+
+// reportUserName is how a payer or participant is shown in a report
+func reportUserName(u *ReportUser) string {
+	switch {
+	case u == nil:
+		return ""
+	case u.Name != "":
+		return u.Name
+	case u.Email != "":
+		return u.Email
+	case u.ID != nil:
+		return u.ID.Hex()
+	}
+	return ""
+}
+
+// writeReportCSV sends the report rows as a downloadable CSV file, one column per grouping
+func writeReportCSV(c *gin.Context, report SpendingReport) {
+	header := []string{}
+	for _, dimension := range reportDimensions {
+		if containsString(report.GroupBy, dimension) {
+			header = append(header, strings.ToUpper(dimension[:1])+dimension[1:])
+		}
+	}
+	header = append(header, "Currency", "Total", "Count")
+	csvData := [][]string{header}
+
+	for _, r := range report.Rows {
+		row := []string{}
+		for _, dimension := range reportDimensions {
+			if !containsString(report.GroupBy, dimension) {
+				continue
+			}
+			switch dimension {
+			case "month":
+				row = append(row, r.Month)
+			case "week":
+				row = append(row, r.Week)
+			case "category":
+				row = append(row, r.Category)
+			case "payer":
+				row = append(row, reportUserName(r.Payer))
+			case "participant":
+				row = append(row, reportUserName(r.Participant))
+			}
+		}
+		row = append(row, r.Currency, utils.FormatAmount(r.Total, r.Currency), strconv.Itoa(r.Count))
+		csvData = append(csvData, row)
+	}
+
+	csvString := &strings.Builder{}
+	writer := csv.NewWriter(csvString)
+	writer.WriteAll(csvData)
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate CSV"})
+		return
+	}
+
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", "attachment; filename=spending_report.csv")
+	c.Data(http.StatusOK, "text/csv", []byte(csvString.String()))
+}
+
+// defaultedField evaluates to the field's value, or fallback when it is missing or empty
+func defaultedField(field, fallback string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{field, ""}}, ""}},
+		field,
+		fallback,
+	}}
+}
+
+// lowerKeys lowercases split_details keys for case-insensitive matching, dropping empty ones
+func lowerKeys(keys []string) bson.A {
+	lowered := bson.A{}
+	for _, key := range keys {
+		if key != "" {
+			lowered = append(lowered, strings.ToLower(key))
+		}
+	}
+	return lowered
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"expenses-backend/utils"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// upiCurrency is the only currency UPI payments can be made in
+	upiCurrency           = "INR"
+	qrCodeSize            = 320
+	maxSettlementNote     = 200
+	maxSettlementRefBytes = 64
+)
+
+var (
+	errNothingOwed           = errors.New("nothing owed")
+	errSettlementExceedsDebt = errors.New("amount exceeds what is owed")
+)
+
+// SettlementInput is the body of confirming that a payer paid a payee
+type SettlementInput struct {
+	Payer    string  `json:"payer" binding:"required"`
+	Payee    string  `json:"payee" binding:"required"`
+	Amount   float64 `json:"amount" binding:"required,gt=0"`
+	Currency string  `json:"currency,omitempty"`
+	// Method is upi, cash or other; defaults to upi
+	Method    string `json:"method,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Note      string `json:"note,omitempty"`
+}
+
+// SettlementPayee is who a suggested transfer goes to
+type SettlementPayee struct {
+	ID     primitive.ObjectID `json:"id"`
+	Name   string             `json:"name"`
+	UPIVPA string             `json:"upi_vpa,omitempty"`
+}
+
+// SettlementTransfer is a payment that settles what the user owes one other
+// user in one currency. UPI details are given for INR amounts owed to users
+// with a UPI VPA.
+type SettlementTransfer struct {
+	To        SettlementPayee `json:"to"`
+	Amount    float64         `json:"amount"`
+	Currency  string          `json:"currency"`
+	UPILink   string          `json:"upi_link,omitempty"`
+	QRCodeURL string          `json:"qr_code_url,omitempty"`
+	// Set with 'convert_to', at today's rate
+	ConvertedCurrency string   `json:"converted_currency,omitempty"`
+	ConvertedAmount   *float64 `json:"converted_amount,omitempty"`
+}
+
+// GetSettleUp handles listing the transfers that settle everything the user given by :user owes
+func GetSettleUp(c *gin.Context) {
+	payer, err := identifyUser(c.Param("user"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid user: ", err))
+		return
+	}
+	converter, ok := parseConvertTo(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	debts, err := userDebts(ctx, payer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate balances"})
+		return
+	}
+	ids := []primitive.ObjectID{}
+	for id, amounts := range debts {
+		if len(positiveAmounts(amounts)) > 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	payees := []models.User{}
+	if len(ids) > 0 {
+		opts := options.Find().SetProjection(bson.M{"name": 1, "upi_vpa": 1})
+		cursor, err := db.UsersCol.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+			return
+		}
+		if err := cursor.All(ctx, &payees); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+			return
+		}
+	}
+	sort.Slice(payees, func(i, j int) bool { return payees[i].Name < payees[j].Name })
+
+	transfers := []SettlementTransfer{}
+	for _, payee := range payees {
+		owed := positiveAmounts(debts[payee.ID])
+		currencies := []string{}
+		for currency := range owed {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		for _, currency := range currencies {
+			transfer := SettlementTransfer{
+				To:       SettlementPayee{ID: payee.ID, Name: payee.Name, UPIVPA: payee.UPIVPA},
+				Amount:   utils.RoundAmount(owed[currency], currency),
+				Currency: currency,
+			}
+			if currency == upiCurrency && payee.UPIVPA != "" {
+				transfer.UPILink = upiLink(payee, payer, transfer.Amount)
+				transfer.QRCodeURL = "/settle/" + payer.ID.Hex() + "/qr?to=" + payee.ID.Hex()
+			}
+			if converter != nil {
+				// What is owed builds up over time, so today's rate applies
+				amount, err := converter.Convert(ctx, transfer.Amount, currency, time.Now())
+				if err != nil {
+					c.JSON(balanceErrorStatus(err), gin.H{"error": "Failed to convert amounts: " + err.Error()})
+					return
+				}
+				amount = utils.RoundAmount(amount, converter.target)
+				transfer.ConvertedCurrency = converter.target
+				transfer.ConvertedAmount = &amount
+			}
+			transfers = append(transfers, transfer)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":      gin.H{"id": payer.ID, "name": payer.Name},
+		"transfers": transfers,
+	})
+}
+
+// GetSettleQRCode handles rendering the UPI payment of what the user given by
+// :user owes the payee given by the 'to' query parameter as a QR code PNG. An
+// optional 'amount' pays part of it.
+func GetSettleQRCode(c *gin.Context) {
+	payer, err := identifyUser(c.Param("user"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid user: ", err))
+		return
+	}
+	to := c.Query("to")
+	if to == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter 'to' is required"})
+		return
+	}
+	payee, err := identifyUser(to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid 'to' identifier: ", err))
+		return
+	}
+	if payee.UPIVPA == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": payee.Name + " has no UPI VPA on their profile"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	debts, err := userDebts(ctx, payer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate balances"})
+		return
+	}
+	owed := utils.RoundAmount(debts[payee.ID][upiCurrency], upiCurrency)
+	if owed <= 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": payer.Name + " doesn't owe " + payee.Name + " anything in " + upiCurrency})
+		return
+	}
+
+	amount := owed
+	if value := c.Query("amount"); value != "" {
+		amount, err = strconv.ParseFloat(value, 64)
+		if err != nil || amount <= 0 || !utils.HasValidPrecision(amount, upiCurrency) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+			return
+		}
+		if amount > owed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Amount exceeds the " + utils.FormatAmount(owed, upiCurrency) + " " + upiCurrency + " owed"})
+			return
+		}
+	}
+
+	png, err := qrcode.Encode(upiLink(payee, payer, amount), qrcode.Medium, qrCodeSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate QR code"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// RecordSettlement handles the payer confirming they paid the payee, which
+// reduces what they owe. It can't be more than is owed.
+func RecordSettlement(c *gin.Context) {
+	var input SettlementInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency := utils.NormalizeCurrency(input.Currency)
+	if _, ok := utils.MinorUnits(currency); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency '" + currency + "'"})
+		return
+	}
+	if !utils.HasValidPrecision(input.Amount, currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount has more decimal places than " + currency + " allows"})
+		return
+	}
+	method := strings.ToLower(strings.TrimSpace(input.Method))
+	switch method {
+	case "":
+		method = models.SettlementUPI
+	case models.SettlementUPI, models.SettlementCash, models.SettlementOther:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "method must be upi, cash or other"})
+		return
+	}
+	reference := strings.TrimSpace(input.Reference)
+	note := strings.TrimSpace(input.Note)
+	if len(reference) > maxSettlementRefBytes || utf8.RuneCountInString(note) > maxSettlementNote {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reference or note is too long"})
+		return
+	}
+
+	payer, err := identifyUser(input.Payer)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid 'payer' identifier: ", err))
+		return
+	}
+	payee, err := identifyUser(input.Payee)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid 'payee' identifier: ", err))
+		return
+	}
+	if payer.ID == payee.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payer and payee must be different users"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session, err := db.Client.StartSession()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+	defer session.EndSession(ctx)
+
+	settlement := models.Settlement{
+		Payer:     payer.ID,
+		Payee:     payee.ID,
+		Amount:    input.Amount,
+		Currency:  currency,
+		Method:    method,
+		Reference: reference,
+		Note:      note,
+		CreatedAt: time.Now(),
+	}
+	var owed float64
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		// Writing the payer first makes concurrent settlements by them conflict and
+		// retry, so together they can't pay more than is owed
+		if _, err := db.UsersCol.UpdateOne(sc, bson.M{"_id": payer.ID}, bson.M{"$set": bson.M{"last_settlement_at": settlement.CreatedAt}}); err != nil {
+			return nil, err
+		}
+		debts, err := userDebts(sc, payer)
+		if err != nil {
+			return nil, err
+		}
+		owed = utils.RoundAmount(debts[payee.ID][currency], currency)
+		if owed <= 0 {
+			return nil, errNothingOwed
+		}
+		if input.Amount > owed {
+			return nil, errSettlementExceedsDebt
+		}
+		result, err := db.SettlementsCol.InsertOne(sc, settlement)
+		if err != nil {
+			return nil, err
+		}
+		settlement.ID = result.InsertedID.(primitive.ObjectID)
+		return nil, nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errNothingOwed):
+			c.JSON(http.StatusConflict, gin.H{"error": payer.Name + " doesn't owe " + payee.Name + " anything in " + currency})
+		case errors.Is(err, errSettlementExceedsDebt):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Amount exceeds the " + utils.FormatAmount(owed, currency) + " " + currency + " owed"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record settlement"})
+		}
+		return
+	}
+
+	recordEvent(models.Event{
+		Type:  models.EventSettlementCreated,
+		Actor: &payer.ID,
+		Users: []primitive.ObjectID{payer.ID, payee.ID},
+		Data: bson.M{
+			"settlement_id": settlement.ID,
+			"payer":         payer.ID,
+			"payee":         payee.ID,
+			"amount":        settlement.Amount,
+			"currency":      currency,
+			"method":        method,
+		},
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"settlement": settlement,
+		"remaining":  utils.RoundAmount(owed-input.Amount, currency),
+	})
+}
+
+// GetSettlements handles listing the settlements paid or received by the user
+// given by the 'identifier' query parameter, newest first
+func GetSettlements(c *gin.Context) {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Identifier (email, mobile_number, or name) is required"})
+		return
+	}
+
+	user, err := identifyUser(identifier)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("Invalid identifier: ", err))
+		return
+	}
+
+	params, err := parsePageParams(c, maxPageLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"$or": []bson.M{{"payer": user.ID}, {"payee": user.ID}}}
+	sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	page, err := findPage(ctx, db.SettlementsCol, filter, sort, params, func(s models.Settlement) bson.D {
+		return bson.D{{Key: "created_at", Value: s.CreatedAt}, {Key: "_id", Value: s.ID}}
+	})
+	if err != nil {
+		if errors.Is(err, errCursorSortMismatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve settlements"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// upiLink builds the upi://pay deep link paying amount INR to the payee. UPI
+// apps expect spaces as %20 and a literal @ in the VPA, so url.Values can't be used.
+func upiLink(payee, payer models.User, amount float64) string {
+	params := [][2]string{
+		{"pa", payee.UPIVPA},
+		{"pn", payee.Name},
+		{"am", utils.FormatAmount(amount, upiCurrency)},
+		{"cu", upiCurrency},
+		{"tn", "Settle up from " + payer.Name},
+	}
+	parts := make([]string, 0, len(params))
+	for _, p := range params {
+		value := strings.NewReplacer("+", "%20", "%40", "@").Replace(url.QueryEscape(p[1]))
+		parts = append(parts, p[0]+"="+value)
+	}
+	return "upi://pay?" + strings.Join(parts, "&")
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/utils"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// maxTagsPerExpense caps how many tags an expense can carry
+	maxTagsPerExpense = 20
+	// maxTagLength caps the length of a single tag
+	maxTagLength = 40
+)
+
+// tagRegex allows lower-case letters, digits, '-' and '_', e.g. goa-trip-2026
+var tagRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]*$`)
+
+type RenameTagInput struct {
+	NewName string `json:"new_name" binding:"required"`
+}
+
+type MergeTagsInput struct {
+	Sources []string `json:"sources" binding:"required,min=1"`
+	Target  string   `json:"target" binding:"required"`
+}
+
+// TagTotal is the number of expenses with a tag and their amounts per currency
+type TagTotal struct {
+	Tag      string             `json:"tag"`
+	Expenses int                `json:"expenses"`
+	Totals   map[string]float64 `json:"totals"`
+}
+
+// GetTags handles listing every tag with its expense count and per-currency totals
+func GetTags(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"tags.0": bson.M{"$exists": true}}},
+		{"$unwind": "$tags"},
+		{"$group": bson.M{
+			"_id":      bson.M{"tag": "$tags", "currency": bson.M{"$ifNull": []interface{}{"$currency", utils.DefaultCurrency}}},
+			"expenses": bson.M{"$sum": 1},
+			"total":    bson.M{"$sum": "$amount"},
+		}},
+	}
+
+	cursor, err := db.ExpensesCol.Aggregate(ctx, pipeline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tags"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	byTag := map[string]*TagTotal{}
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				Tag      string `bson:"tag"`
+				Currency string `bson:"currency"`
+			} `bson:"_id"`
+			Expenses int     `bson:"expenses"`
+			Total    float64 `bson:"total"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse tags"})
+			return
+		}
+		t, ok := byTag[row.ID.Tag]
+		if !ok {
+			t = &TagTotal{Tag: row.ID.Tag, Totals: map[string]float64{}}
+			byTag[row.ID.Tag] = t
+		}
+		t.Expenses += row.Expenses
+		t.Totals[utils.NormalizeCurrency(row.ID.Currency)] += row.Total
+	}
+
+	tags := []TagTotal{}
+	for _, t := range byTag {
+		tags = append(tags, *t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+
+	c.JSON(http.StatusOK, tags)
+}
+
+// RenameTag handles renaming a tag on every expense
+func RenameTag(c *gin.Context) {
+	var input RenameTagInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	mergeTagsResponse(c, []string{c.Param("tag")}, input.NewName)
+}
+
+// MergeTags handles folding several tags into a target tag on every expense
+func MergeTags(c *gin.Context) {
+	var input MergeTagsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	mergeTagsResponse(c, input.Sources, input.Target)
+}
+
+func mergeTagsResponse(c *gin.Context, sources []string, target string) {
+	target, err := normalizeTag(target)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Validate every source before changing any expense. normalizeTags would
+	// also apply the per-expense tag limit, which doesn't apply here.
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, source := range sources {
+		source, err := normalizeTag(source)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !seen[source] {
+			seen[source] = true
+			normalized = append(normalized, source)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	updated := int64(0)
+	for _, source := range normalized {
+		if source == target {
+			continue
+		}
+		n, err := replaceTag(ctx, source, target)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+			return
+		}
+		updated += n
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tag": target, "expenses_updated": updated})
+}
+
+// replaceTag replaces source with target on all expenses, dropping source where target is already present
+func replaceTag(ctx context.Context, source, target string) (int64, error) {
+	pulled, err := db.ExpensesCol.UpdateMany(ctx,
+		bson.M{"tags": bson.M{"$all": []string{source, target}}},
+		bson.M{"$pull": bson.M{"tags": source}},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	renamed, err := db.ExpensesCol.UpdateMany(ctx,
+		bson.M{"tags": source},
+		bson.M{"$set": bson.M{"tags.$": target}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return pulled.ModifiedCount + renamed.ModifiedCount, nil
+}
+
+// normalizeTag lower-cases a tag and replaces spaces with '-'
+func normalizeTag(tag string) (string, error) {
+	tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+	if tag == "" {
+		return "", errors.New("tag must not be empty")
+	}
+	if len(tag) > maxTagLength {
+		return "", fmt.Errorf("tag '%s' is longer than %d characters", tag, maxTagLength)
+	}
+	if !tagRegex.MatchString(tag) {
+		return "", fmt.Errorf("tag '%s' may only contain letters, digits, '-' and '_'", tag)
+	}
+	return tag, nil
+}
+
+// normalizeTags normalizes and de-duplicates an expense's tags, keeping their order
+func normalizeTags(tags []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	if len(result) > maxTagsPerExpense {
+		return nil, fmt.Errorf("an expense can have at most %d tags", maxTagsPerExpense)
+	}
+	return result, nil
+}
+
+// tagQueryFilter builds the tags condition for the 'tag' and 'tag_match' query parameters.
+// Tags may be repeated or comma-separated; tag_match=all requires every tag, any (default) one of them.
+func tagQueryFilter(c *gin.Context) (interface{}, error) {
+	raw := []string{}
+	for _, value := range c.QueryArray("tag") {
+		raw = append(raw, strings.Split(value, ",")...)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	tags := []string{}
+	for _, tag := range raw {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	switch c.DefaultQuery("tag_match", "any") {
+	case "all":
+		return bson.M{"$all": tags}, nil
+	case "any":
+		return bson.M{"$in": tags}, nil
+	default:
+		return nil, errors.New("tag_match must be 'all' or 'any'")
+	}
+}
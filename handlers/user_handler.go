@@ -6,8 +6,11 @@ import (
 	"expenses-backend/db"
 	"expenses-backend/models"
 	"fmt"
+	"log"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,10 +19,21 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var validate = validator.New()
 
+var (
+	emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}$`)
+	phoneRegex = regexp.MustCompile(`^[6-9]\d{9}$`) // Indian 10-digit phone number
+	// UPI virtual payment address, e.g. priya@okaxis
+	vpaRegex = regexp.MustCompile(`^[a-z0-9._\-]{2,256}@[a-z][a-z0-9]{1,63}$`)
+)
+
+// errUserNotFound is wrapped by identifyUser when no user matches the identifier
+var errUserNotFound = errors.New("no user found")
+
 // CreateUser handles creating a new user
 func CreateUser(c *gin.Context) {
 	var user models.User
@@ -37,13 +51,57 @@ func CreateUser(c *gin.Context) {
 	user.Name = strings.TrimSpace(user.Name)
 	user.Email = strings.TrimSpace(strings.ToLower(user.Email))
 	user.MobileNumber = strings.TrimSpace(user.MobileNumber)
+	user.UPIVPA = strings.TrimSpace(strings.ToLower(user.UPIVPA))
 	user.CreatedAt = time.Now()
 
+	if user.UPIVPA != "" && !vpaRegex.MatchString(user.UPIVPA) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid UPI VPA, expected an address like name@bank"})
+		return
+	}
+
+	// Server-managed fields are never taken from the request
+	user.PreviousEmails = nil
+	user.PreviousMobileNumbers = nil
+	user.Placeholder = false
+	user.ClaimedAt = nil
+	user.MergedInto = nil
+	user.MergedAt = nil
+
 	// Insert into MongoDB
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := db.UsersCol.InsertOne(ctx, user)
+	// A signup matching placeholders created from expenses takes them over
+	placeholders, err := findPlaceholders(ctx, user.Email, user.MobileNumber)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	if len(placeholders) > 0 {
+		claimed, err := claimPlaceholders(ctx, user, placeholders)
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Email or mobile number already exists"})
+				return
+			}
+			if errors.Is(err, errTransactionsUnsupported) {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Claiming two placeholder users at once " + err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim placeholder user"})
+			return
+		}
+		recordEvent(models.Event{
+			Type:  models.EventUserCreated,
+			Actor: &claimed.ID,
+			Users: []primitive.ObjectID{claimed.ID},
+			Data:  bson.M{"claimed_placeholder": true},
+		})
+		c.JSON(http.StatusCreated, claimed)
+		return
+	}
+
+	result, err := db.UsersCol.InsertOne(ctx, user)
 	if err != nil {
 		if mongoErr, ok := err.(mongo.WriteException); ok {
 			for _, we := range mongoErr.WriteErrors {
@@ -57,7 +115,9 @@ func CreateUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
+	user.ID = result.InsertedID.(primitive.ObjectID)
 
+	recordEvent(models.Event{Type: models.EventUserCreated, Actor: &user.ID, Users: []primitive.ObjectID{user.ID}})
 	c.JSON(http.StatusCreated, user)
 }
 
@@ -69,70 +129,525 @@ func GetUser(c *gin.Context) {
 		return
 	}
 
-	user, err := identifyUser(identifier)
+	user, deprecated, err := lookupUser(identifier)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, identifyErrorResponse("", err))
+		return
+	}
+
+	if deprecated {
+		c.JSON(http.StatusOK, struct {
+			models.User
+			DeprecatedIdentifier bool `json:"deprecated_identifier"`
+		}{user, true})
 		return
 	}
 
 	c.JSON(http.StatusOK, user)
 }
 
-// identifyUser identifies a user based on email, phone, or name
+// UserUpdateInput holds the profile fields that can be changed; omitted fields are left as is
+type UserUpdateInput struct {
+	Name         *string `json:"name" validate:"omitempty,min=1"`
+	Email        *string `json:"email" validate:"omitempty,email"`
+	MobileNumber *string `json:"mobile_number" validate:"omitempty,min=1"`
+	// UPIVPA is the user's UPI address; an empty string removes it
+	UPIVPA *string `json:"upi_vpa"`
+}
+
+// previousIdentifierGracePeriod is how long a replaced email or mobile number still resolves
+const previousIdentifierGracePeriod = 90 * 24 * time.Hour
+
+// UpdateUser handles updating a user's name, email, mobile number or UPI VPA
+func UpdateUser(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+
+	var input UserUpdateInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if err := validate.Struct(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Identifiers must stay resolvable by identifyUser
+	if input.Name != nil && strings.TrimSpace(*input.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name must not be blank"})
+		return
+	}
+	if input.Email != nil && !emailRegex.MatchString(strings.TrimSpace(strings.ToLower(*input.Email))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
+	if input.MobileNumber != nil && !phoneRegex.MatchString(strings.TrimSpace(*input.MobileNumber)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mobile number, expected a 10-digit Indian mobile number"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var existing models.User
+	if err := db.UsersCol.FindOne(ctx, bson.M{"_id": userID}).Decode(&existing); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	if existing.MergedInto != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User has been merged into " + existing.MergedInto.Hex()})
+		return
+	}
+
+	now := time.Now()
+	set := bson.M{"updated_at": now}
+	push := bson.M{}
+
+	if input.Name != nil {
+		set["name"] = strings.TrimSpace(*input.Name)
+	}
+	if input.Email != nil {
+		email := strings.TrimSpace(strings.ToLower(*input.Email))
+		if email != existing.Email {
+			set["email"] = email
+			push["previous_emails"] = models.PreviousIdentifier{Value: existing.Email, ReplacedAt: now}
+		}
+	}
+	if input.MobileNumber != nil {
+		mobile := strings.TrimSpace(*input.MobileNumber)
+		if mobile != existing.MobileNumber {
+			set["mobile_number"] = mobile
+			push["previous_mobile_numbers"] = models.PreviousIdentifier{Value: existing.MobileNumber, ReplacedAt: now}
+		}
+	}
+
+	update := bson.M{"$set": set}
+	if input.UPIVPA != nil {
+		vpa := strings.TrimSpace(strings.ToLower(*input.UPIVPA))
+		if vpa == "" {
+			update["$unset"] = bson.M{"upi_vpa": ""}
+		} else if !vpaRegex.MatchString(vpa) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid UPI VPA, expected an address like name@bank"})
+			return
+		} else {
+			set["upi_vpa"] = vpa
+		}
+	}
+	if len(push) > 0 {
+		update["$push"] = push
+	}
+
+	var updated models.User
+	findOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = db.UsersCol.FindOneAndUpdate(ctx, bson.M{"_id": userID}, update, findOptions).Decode(&updated)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email or mobile number already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	recordEvent(models.Event{Type: models.EventUserUpdated, Actor: &updated.ID, Users: []primitive.ObjectID{updated.ID}})
+	c.JSON(http.StatusOK, updated)
+}
+
+// UserCandidate is a masked summary of a user matching an ambiguous identifier
+type UserCandidate struct {
+	ID           primitive.ObjectID `json:"id"`
+	Name         string             `json:"name"`
+	Email        string             `json:"email"`
+	MobileNumber string             `json:"mobile_number"`
+}
+
+// AmbiguousUserError is returned when a name identifies more than one user
+type AmbiguousUserError struct {
+	Identifier string
+	Candidates []UserCandidate
+}
+
+func (e *AmbiguousUserError) Error() string {
+	return fmt.Sprintf("multiple users found with the name '%s'. Please use the id, email or mobile number to identify the user", e.Identifier)
+}
+
+// newUserCandidate summarizes a user with their email and mobile number masked
+func newUserCandidate(u models.User) UserCandidate {
+	return UserCandidate{
+		ID:           u.ID,
+		Name:         u.Name,
+		Email:        maskEmail(u.Email),
+		MobileNumber: maskMobileNumber(u.MobileNumber),
+	}
+}
+
+func newAmbiguousUserError(identifier string, users []models.User) *AmbiguousUserError {
+	candidates := make([]UserCandidate, 0, len(users))
+	for _, u := range users {
+		candidates = append(candidates, newUserCandidate(u))
+	}
+	return &AmbiguousUserError{Identifier: identifier, Candidates: candidates}
+}
+
+// identifyErrorResponse builds the error body for a failed identifyUser call,
+// listing the candidates when the identifier was ambiguous
+func identifyErrorResponse(prefix string, err error) gin.H {
+	resp := gin.H{"error": prefix + err.Error()}
+	var ambiguous *AmbiguousUserError
+	if errors.As(err, &ambiguous) {
+		resp["candidates"] = ambiguous.Candidates
+	}
+	return resp
+}
+
+// identifyErrorStatus is the response status for an identifyUser error: a client
+// error when no user or several users match, a server error otherwise
+func identifyErrorStatus(err error) int {
+	var ambiguous *AmbiguousUserError
+	if errors.Is(err, errUserNotFound) || errors.As(err, &ambiguous) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// maskEmail keeps the first and last character of the local part, e.g. p***a@example.com
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return strings.Repeat("*", len(email))
+	}
+	local, domain := email[:at], email[at:]
+	if len(local) <= 2 {
+		return strings.Repeat("*", len(local)) + domain
+	}
+	return local[:1] + "***" + local[len(local)-1:] + domain
+}
+
+// maskMobileNumber keeps only the last four digits, e.g. ******6789
+func maskMobileNumber(mobile string) string {
+	if len(mobile) <= 4 {
+		return strings.Repeat("*", len(mobile))
+	}
+	return strings.Repeat("*", len(mobile)-4) + mobile[len(mobile)-4:]
+}
+
+const (
+	// maxSearchLimit caps the page size of a user search
+	maxSearchLimit = 50
+	// maxSearchCandidates caps how many matches are ranked per search
+	maxSearchCandidates = 200
+	// minFuzzyQueryLength is the shortest query matched as a subsequence
+	minFuzzyQueryLength = 3
+	// indexNotFoundCode is MongoDB's error code for a query needing a missing index
+	indexNotFoundCode = 27
+)
+
+// SearchUsers handles prefix and fuzzy user search across name, email and mobile number
+func SearchUsers(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter 'q' is required"})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page parameter"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+		return
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lowered := strings.ToLower(query)
+	quoted := regexp.QuoteMeta(lowered)
+
+	// Email and mobile number are matched on prefix so the unique indexes can be used
+	fuzzy := []bson.M{{"name": primitive.Regex{Pattern: quoted, Options: "i"}}}
+	if len([]rune(lowered)) >= minFuzzyQueryLength {
+		fuzzy = append(fuzzy, bson.M{"name": primitive.Regex{Pattern: subsequencePattern(lowered), Options: "i"}})
+	}
+
+	// Candidates are gathered from the closest matches down, so a common query
+	// can't crowd exact and prefix matches out of the ranked set
+	tiers := []bson.M{
+		{"$or": []bson.M{
+			{"name": primitive.Regex{Pattern: "^" + quoted + "$", Options: "i"}},
+			{"email": lowered},
+			{"mobile_number": query},
+		}},
+		{"$or": []bson.M{
+			{"name": primitive.Regex{Pattern: "^" + quoted, Options: "i"}},
+			{"email": primitive.Regex{Pattern: "^" + quoted}},
+			{"mobile_number": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query)}},
+		}},
+	}
+	// Whole words of the name or email, from the text index
+	if terms := textSearchTerms(query); terms != "" {
+		tiers = append(tiers, bson.M{"$text": bson.M{"$search": terms}})
+	}
+	tiers = append(tiers, bson.M{"$or": fuzzy})
+
+	type rankedUser struct {
+		user  models.User
+		score int
+	}
+
+	ranked := []rankedUser{}
+	seen := []primitive.ObjectID{}
+	for _, filter := range tiers {
+		if len(ranked) >= maxSearchCandidates {
+			break
+		}
+		filter["merged_into"] = bson.M{"$exists": false}
+		filter["_id"] = bson.M{"$nin": seen}
+		findOptions := options.Find().SetLimit(int64(maxSearchCandidates - len(ranked)))
+		cursor, err := db.UsersCol.Find(ctx, filter, findOptions)
+		if err != nil {
+			if isTextIndexMissing(err) {
+				// The regex tiers still find these users, just ranked by position
+				log.Printf("Searching users without the text index: %v", err)
+				continue
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+			return
+		}
+		matches := []models.User{}
+		if err := cursor.All(ctx, &matches); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse users"})
+			return
+		}
+		for _, user := range matches {
+			seen = append(seen, user.ID)
+			ranked = append(ranked, rankedUser{user: user, score: searchScore(user, lowered)})
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return strings.ToLower(ranked[i].user.Name) < strings.ToLower(ranked[j].user.Name)
+	})
+
+	// Like ambiguous-name candidates, search results never reveal contact details
+	users := []UserCandidate{}
+	start := (page - 1) * limit
+	for i := start; i < len(ranked) && i < start+limit; i++ {
+		users = append(users, newUserCandidate(ranked[i].user))
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// textSearchTerms turns a search query into plain $text search terms, dropping
+// the quotes and leading '-' that $search reads as phrases and negations
+func textSearchTerms(query string) string {
+	terms := []string{}
+	for _, word := range strings.Fields(strings.ReplaceAll(query, `"`, " ")) {
+		if word = strings.TrimLeft(word, "-"); word != "" {
+			terms = append(terms, word)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// isTextIndexMissing reports whether a $text query failed for want of a text index
+func isTextIndexMissing(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(indexNotFoundCode)
+}
+
+// searchScore ranks how closely a user matches a lowercased search query
+func searchScore(user models.User, query string) int {
+	best := 0
+	for _, field := range []string{strings.ToLower(user.Name), user.Email, user.MobileNumber} {
+		score := 0
+		switch {
+		case field == query:
+			score = 100
+		case strings.HasPrefix(field, query):
+			score = 80
+		case hasWordPrefix(field, query):
+			score = 60
+		case strings.Contains(field, query):
+			score = 40
+		case isSubsequence(query, field):
+			score = 20
+		}
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// hasWordPrefix reports whether any word in s starts with prefix
+func hasWordPrefix(s, prefix string) bool {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '.' || r == '_' || r == '-' || r == '@'
+	})
+	for _, w := range words {
+		if strings.HasPrefix(w, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubsequence reports whether all runes of sub appear in s in order
+func isSubsequence(sub, s string) bool {
+	runes := []rune(sub)
+	i := 0
+	for _, r := range s {
+		if i < len(runes) && r == runes[i] {
+			i++
+		}
+	}
+	return i == len(runes)
+}
+
+// subsequencePattern builds a regex matching the query's characters in order
+func subsequencePattern(query string) string {
+	parts := []string{}
+	for _, r := range query {
+		parts = append(parts, regexp.QuoteMeta(string(r)))
+	}
+	return strings.Join(parts, ".*")
+}
+
+// identifyUser identifies a user based on id, email, phone, or name
 func identifyUser(identifier string) (models.User, error) {
-	var user models.User
+	user, _, err := lookupUser(identifier)
+	return user, err
+}
+
+// maxMergeHops bounds how many merge tombstones lookupUser follows
+const maxMergeHops = 5
+
+// lookupUser identifies a user like identifyUser, following merge tombstones, and
+// additionally reports whether the identifier matched a replaced email or mobile
+// number still within its grace period
+func lookupUser(identifier string) (models.User, bool, error) {
+	user, deprecated, err := lookupUserRecord(identifier)
+	if err != nil || user.MergedInto == nil {
+		return user, deprecated, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	emailRegex := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}$`)
-	phoneRegex := regexp.MustCompile(`^[6-9]\d{9}$`) // Indian 10-digit phone number
+	// Merges re-point older tombstones, but tombstones from before that may chain
+	for hops := 0; user.MergedInto != nil; hops++ {
+		if hops == maxMergeHops {
+			return user, false, errors.New("too many merged accounts in a row")
+		}
+		var target models.User
+		if err := db.UsersCol.FindOne(ctx, bson.M{"_id": *user.MergedInto}).Decode(&target); err != nil {
+			return target, false, err
+		}
+		user = target
+	}
+	return user, deprecated, nil
+}
+
+// lookupUserRecord finds the user document matching identifier, which may be a merge tombstone
+func lookupUserRecord(identifier string) (models.User, bool, error) {
+	var user models.User
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
 	identifier = strings.TrimSpace(identifier)
 
-	if emailRegex.MatchString(identifier) {
-		filter := bson.M{"email": strings.ToLower(identifier)}
-		err := db.UsersCol.FindOne(ctx, filter).Decode(&user)
-		if err != nil {
+	if id, err := primitive.ObjectIDFromHex(identifier); err == nil {
+		err := db.UsersCol.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			return user, false, fmt.Errorf("%w with the given id", errUserNotFound)
+		}
+		return user, false, err
+	} else if emailRegex.MatchString(identifier) {
+		email := strings.ToLower(identifier)
+		err := db.UsersCol.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			user, err = findByPreviousIdentifier(ctx, "previous_emails", email)
 			if err == mongo.ErrNoDocuments {
-				return user, errors.New("no user found with the given email")
+				return user, false, fmt.Errorf("%w with the given email", errUserNotFound)
 			}
-			return user, err
+			return user, err == nil, err
 		}
-		return user, nil
+		return user, false, err
 	} else if phoneRegex.MatchString(identifier) {
-		filter := bson.M{"mobile_number": identifier}
-		err := db.UsersCol.FindOne(ctx, filter).Decode(&user)
-		if err != nil {
+		err := db.UsersCol.FindOne(ctx, bson.M{"mobile_number": identifier}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			user, err = findByPreviousIdentifier(ctx, "previous_mobile_numbers", identifier)
 			if err == mongo.ErrNoDocuments {
-				return user, errors.New("no user found with the given mobile number")
+				return user, false, fmt.Errorf("%w with the given mobile number", errUserNotFound)
 			}
-			return user, err
+			return user, err == nil, err
 		}
-		return user, nil
+		return user, false, err
 	} else {
-		// Treat as name (case-insensitive)
-		filter := bson.M{"name": primitive.Regex{Pattern: fmt.Sprintf("^%s$", regexp.QuoteMeta(strings.ToLower(identifier))), Options: "i"}}
-		cursor, err := db.UsersCol.Find(ctx, filter)
-		if err != nil {
-			return user, err
-		}
-		defer cursor.Close(ctx)
+		user, err := identifyUserByName(ctx, identifier)
+		return user, false, err
+	}
+}
 
-		users := []models.User{}
-		for cursor.Next(ctx) {
-			var u models.User
-			if err := cursor.Decode(&u); err != nil {
-				return user, err
-			}
-			users = append(users, u)
-		}
+// findByPreviousIdentifier finds the user who replaced value within previousIdentifierGracePeriod
+func findByPreviousIdentifier(ctx context.Context, field, value string) (models.User, error) {
+	var user models.User
+	filter := bson.M{field: bson.M{"$elemMatch": bson.M{
+		"value":       value,
+		"replaced_at": bson.M{"$gte": time.Now().Add(-previousIdentifierGracePeriod)},
+	}}}
+	err := db.UsersCol.FindOne(ctx, filter).Decode(&user)
+	return user, err
+}
 
-		if len(users) == 1 {
-			return users[0], nil
-		} else if len(users) > 1 {
-			return user, fmt.Errorf("multiple users found with the name '%s'. Please use email or mobile number to identify the user", identifier)
-		} else {
-			return user, fmt.Errorf("no user found with the identifier '%s'", identifier)
+// identifyUserByName identifies a user by case-insensitive name
+func identifyUserByName(ctx context.Context, identifier string) (models.User, error) {
+	var user models.User
+	filter := bson.M{
+		"name":        primitive.Regex{Pattern: fmt.Sprintf("^%s$", regexp.QuoteMeta(strings.ToLower(identifier))), Options: "i"},
+		"merged_into": bson.M{"$exists": false},
+	}
+	cursor, err := db.UsersCol.Find(ctx, filter)
+	if err != nil {
+		return user, err
+	}
+	defer cursor.Close(ctx)
+
+	users := []models.User{}
+	for cursor.Next(ctx) {
+		var u models.User
+		if err := cursor.Decode(&u); err != nil {
+			return user, err
 		}
+		users = append(users, u)
+	}
+
+	if len(users) == 1 {
+		return users[0], nil
+	} else if len(users) > 1 {
+		return user, newAmbiguousUserError(identifier, users)
 	}
+	return user, fmt.Errorf("%w with the identifier '%s'", errUserNotFound, identifier)
 }
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxDeliveryAttempts = 8
+	firstRetryDelay     = 30 * time.Second
+	maxRetryDelay       = 6 * time.Hour
+	// deliveryLease is how long a claimed delivery is hidden from other dispatchers
+	deliveryLease       = 2 * time.Minute
+	maxLoggedResponse   = 1024
+	webhookTimeout      = 10 * time.Second
+	deliveriesPerWakeup = 50
+)
+
+// webhookClient sends deliveries; redirects are not followed so a receiver
+// can't bounce signed payloads elsewhere
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookWake nudges the dispatcher when deliveries are queued
+var webhookWake = make(chan struct{}, 1)
+
+// WebhookPayload is the JSON body POSTed to webhooks
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// StartWebhookDispatcher sends queued webhook deliveries in the background,
+// checking for due retries every interval
+func StartWebhookDispatcher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			sendDueDeliveries()
+			select {
+			case <-ticker.C:
+			case <-webhookWake:
+			}
+		}
+	}()
+}
+
+// enqueueWebhookDeliveries queues the event for every active webhook subscribed to its type
+func enqueueWebhookDeliveries(ctx context.Context, event models.Event) {
+	cursor, err := db.WebhooksCol.Find(ctx, bson.M{"active": true, "events": event.Type})
+	if err != nil {
+		log.Printf("Failed to find webhooks for %s event: %v", event.Type, err)
+		return
+	}
+	webhooks := []models.Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		log.Printf("Failed to find webhooks for %s event: %v", event.Type, err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		ID:        event.ID.Hex(),
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt,
+		Data:      webhookEventData(ctx, event),
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s webhook payload: %v", event.Type, err)
+		return
+	}
+
+	deliveries := []interface{}{}
+	for _, webhook := range webhooks {
+		deliveries = append(deliveries, newDelivery(webhook.ID, &event.ID, event.Type, payload))
+	}
+	if _, err := db.DeliveriesCol.InsertMany(ctx, deliveries); err != nil {
+		log.Printf("Failed to queue %s webhook deliveries: %v", event.Type, err)
+		return
+	}
+
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookEventData is the payload's data: the event plus the expense, user or settlement it is about
+func webhookEventData(ctx context.Context, event models.Event) bson.M {
+	data := bson.M{"event": event}
+	switch {
+	case event.ExpenseID != nil:
+		var expense models.Expense
+		if err := db.ExpensesCol.FindOne(ctx, bson.M{"_id": *event.ExpenseID}).Decode(&expense); err == nil {
+			data["expense"] = expense
+		}
+	case strings.HasPrefix(event.Type, "user.") && len(event.Users) > 0:
+		var user models.User
+		if err := db.UsersCol.FindOne(ctx, bson.M{"_id": event.Users[0]}).Decode(&user); err == nil {
+			data["user"] = user
+		}
+	case event.Type == models.EventSettlementCreated:
+		var settlement models.Settlement
+		if err := db.SettlementsCol.FindOne(ctx, bson.M{"_id": event.Data["settlement_id"]}).Decode(&settlement); err == nil {
+			data["settlement"] = settlement
+		}
+	}
+	return data
+}
+
+func newDelivery(webhookID primitive.ObjectID, eventID *primitive.ObjectID, eventType string, payload []byte) models.WebhookDelivery {
+	now := time.Now()
+	return models.WebhookDelivery{
+		ID:            primitive.NewObjectID(),
+		WebhookID:     webhookID,
+		EventID:       eventID,
+		EventType:     eventType,
+		Payload:       string(payload),
+		Status:        models.DeliveryPending,
+		Attempts:      []models.DeliveryAttempt{},
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+	}
+}
+
+// sendDueDeliveries attempts the pending deliveries that are due
+func sendDueDeliveries() {
+	for i := 0; i < deliveriesPerWakeup; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout+10*time.Second)
+		delivery, ok := claimDelivery(ctx)
+		if ok {
+			attemptDelivery(ctx, delivery)
+		}
+		cancel()
+		if !ok {
+			return
+		}
+	}
+}
+
+// claimDelivery leases the next due delivery so that concurrent dispatchers,
+// e.g. in other server instances, don't send it twice
+func claimDelivery(ctx context.Context) (models.WebhookDelivery, bool) {
+	var delivery models.WebhookDelivery
+	now := time.Now()
+	filter := bson.M{"status": models.DeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(deliveryLease)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}})
+	if err := db.DeliveriesCol.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to claim webhook delivery: %v", err)
+		}
+		return delivery, false
+	}
+	return delivery, true
+}
+
+// attemptDelivery POSTs a delivery once and records the outcome, scheduling a
+// retry with exponential backoff on failure
+func attemptDelivery(ctx context.Context, delivery models.WebhookDelivery) models.WebhookDelivery {
+	var webhook models.Webhook
+	err := db.WebhooksCol.FindOne(ctx, bson.M{"_id": delivery.WebhookID}).Decode(&webhook)
+	if err == mongo.ErrNoDocuments || (err == nil && !webhook.Active) {
+		// The webhook was deleted or paused; drop its queue
+		delivery.Status = models.DeliveryFailed
+		delivery.NextAttemptAt = nil
+		if _, err := db.DeliveriesCol.UpdateOne(ctx, bson.M{"_id": delivery.ID}, bson.M{
+			"$set":   bson.M{"status": models.DeliveryFailed},
+			"$unset": bson.M{"next_attempt_at": ""},
+		}); err != nil {
+			log.Printf("Failed to drop webhook delivery %s: %v", delivery.ID.Hex(), err)
+		}
+		return delivery
+	}
+	if err != nil {
+		return delivery
+	}
+
+	attempt := sendWebhook(ctx, webhook, delivery)
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	set := bson.M{}
+	unset := bson.M{}
+	switch {
+	case attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300:
+		delivery.Status = models.DeliverySucceeded
+		delivery.DeliveredAt = &attempt.At
+		delivery.NextAttemptAt = nil
+		set["delivered_at"] = attempt.At
+		unset["next_attempt_at"] = ""
+	case len(delivery.Attempts) >= maxDeliveryAttempts:
+		delivery.Status = models.DeliveryFailed
+		delivery.NextAttemptAt = nil
+		unset["next_attempt_at"] = ""
+	default:
+		next := attempt.At.Add(retryDelay(len(delivery.Attempts)))
+		delivery.NextAttemptAt = &next
+		set["next_attempt_at"] = next
+	}
+	set["status"] = delivery.Status
+
+	update := bson.M{"$set": set, "$push": bson.M{"attempts": attempt}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if _, err := db.DeliveriesCol.UpdateOne(ctx, bson.M{"_id": delivery.ID}, update); err != nil {
+		log.Printf("Failed to record webhook delivery %s: %v", delivery.ID.Hex(), err)
+	}
+	return delivery
+}
+
+// sendWebhook POSTs the delivery's payload, signed with the webhook's secret
+func sendWebhook(ctx context.Context, webhook models.Webhook, delivery models.WebhookDelivery) models.DeliveryAttempt {
+	start := time.Now()
+	attempt := models.DeliveryAttempt{At: start}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "expenses-backend-webhooks/1")
+	req.Header.Set("X-Webhook-Id", webhook.ID.Hex())
+	req.Header.Set("X-Webhook-Delivery", delivery.ID.Hex())
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhookPayload(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+	resp, err := webhookClient.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedResponse))
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = strings.ToValidUTF8(string(body), "")
+	return attempt
+}
+
+// signWebhookPayload returns the hex HMAC-SHA256 of "<timestamp>.<payload>".
+// Including the timestamp lets receivers reject replayed deliveries.
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay is the backoff before the attempt following the given number of
+// failed attempts: 30s, 1m, 2m, ... capped at 6h
+func retryDelay(failures int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expenses-backend/models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSendWebhookSignsPayload(t *testing.T) {
+	const secret = "whsec_test"
+	payload := `{"id":"1","type":"expense.created","data":{"amount":250}}`
+
+	var (
+		header http.Header
+		body   []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	webhook := models.Webhook{ID: primitive.NewObjectID(), URL: server.URL, Secret: secret, Active: true}
+	delivery := models.WebhookDelivery{ID: primitive.NewObjectID(), WebhookID: webhook.ID, EventType: "expense.created", Payload: payload}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	attempt := sendWebhook(ctx, webhook, delivery)
+
+	if attempt.Error != "" {
+		t.Fatalf("unexpected error: %s", attempt.Error)
+	}
+	if attempt.StatusCode != http.StatusAccepted || attempt.Response != "ok" {
+		t.Errorf("got status %d and response %q, want 202 and \"ok\"", attempt.StatusCode, attempt.Response)
+	}
+	if string(body) != payload {
+		t.Errorf("got body %q, want %q", body, payload)
+	}
+
+	for name, want := range map[string]string{
+		"Content-Type":       "application/json",
+		"X-Webhook-Id":       webhook.ID.Hex(),
+		"X-Webhook-Delivery": delivery.ID.Hex(),
+		"X-Webhook-Event":    "expense.created",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+
+	timestamp := header.Get("X-Webhook-Timestamp")
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Fatalf("invalid X-Webhook-Timestamp %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := header.Get("X-Webhook-Signature"); got != want {
+		t.Errorf("got X-Webhook-Signature %q, want %q", got, want)
+	}
+}
+
+func TestSendWebhookDoesNotFollowRedirects(t *testing.T) {
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect was followed")
+	}))
+	defer elsewhere.Close()
+	server := httptest.NewServer(http.RedirectHandler(elsewhere.URL, http.StatusTemporaryRedirect))
+	defer server.Close()
+
+	webhook := models.Webhook{ID: primitive.NewObjectID(), URL: server.URL, Secret: "s", Active: true}
+	attempt := sendWebhook(context.Background(), webhook, models.WebhookDelivery{ID: primitive.NewObjectID(), Payload: "{}"})
+	if attempt.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("got status %d, want %d", attempt.StatusCode, http.StatusTemporaryRedirect)
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	// HMAC-SHA256 of "1700000000.{}" with the key "secret"
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000.{}"))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if got := signWebhookPayload("secret", "1700000000", []byte("{}")); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := signWebhookPayload("other", "1700000000", []byte("{}")); got == want {
+		t.Error("signature does not depend on the secret")
+	}
+	if got := signWebhookPayload("secret", "1700000001", []byte("{}")); got == want {
+		t.Error("signature does not depend on the timestamp")
+	}
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expenses-backend/db"
+	"expenses-backend/models"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// webhookEventTypes are the event types webhooks can subscribe to
+var webhookEventTypes = map[string]bool{
+	models.EventUserCreated:       true,
+	models.EventUserUpdated:       true,
+	models.EventUserMerged:        true,
+	models.EventExpenseCreated:    true,
+	models.EventExpenseUpdated:    true,
+	models.EventCommentCreated:    true,
+	models.EventCommentUpdated:    true,
+	models.EventCommentDeleted:    true,
+	models.EventReminderSent:      true,
+	models.EventSettlementCreated: true,
+	models.EventBudgetThreshold:   true,
+}
+
+// webhookTestEvent is the event type of deliveries sent by TestWebhook
+const webhookTestEvent = "webhook.test"
+
+type WebhookInput struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events" binding:"required,min=1"`
+	// Secret signs payloads; one is generated when empty
+	Secret string `json:"secret,omitempty"`
+	Active *bool  `json:"active,omitempty"`
+}
+
+// CreateWebhook handles subscribing a URL to event types
+func CreateWebhook(c *gin.Context) {
+	var input WebhookInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	webhookURL, events, err := validateWebhookInput(input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret := input.Secret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+			return
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	now := time.Now()
+	webhook := models.Webhook{
+		URL:       webhookURL,
+		Secret:    secret,
+		Events:    events,
+		Active:    input.Active == nil || *input.Active,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.WebhooksCol.InsertOne(ctx, webhook)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	webhook.ID = result.InsertedID.(primitive.ObjectID)
+
+	// The secret is only ever shown here
+	c.JSON(http.StatusCreated, struct {
+		models.Webhook
+		Secret string `json:"secret"`
+	}{webhook, secret})
+}
+
+// GetWebhooks handles listing webhooks
+func GetWebhooks(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.WebhooksCol.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhooks"})
+		return
+	}
+	webhooks := []models.Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// UpdateWebhook handles changing a webhook's URL, events, secret or active flag
+func UpdateWebhook(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return
+	}
+
+	var input WebhookInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	webhookURL, events, err := validateWebhookInput(input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	set := bson.M{"url": webhookURL, "events": events, "updated_at": time.Now()}
+	if input.Secret != "" {
+		set["secret"] = input.Secret
+	}
+	if input.Active != nil {
+		set["active"] = *input.Active
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var webhook models.Webhook
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := db.WebhooksCol.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": set}, opts).Decode(&webhook); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhook handles removing a webhook. Its pending deliveries are dropped.
+func DeleteWebhook(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.WebhooksCol.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	db.DeliveriesCol.UpdateMany(ctx, bson.M{"webhook_id": id, "status": models.DeliveryPending}, bson.M{
+		"$set":   bson.M{"status": models.DeliveryFailed},
+		"$unset": bson.M{"next_attempt_at": ""},
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries handles listing a webhook's deliveries and their attempts,
+// newest first, optionally only those with the given 'status'
+func GetWebhookDeliveries(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return
+	}
+
+	filter := bson.M{"webhook_id": id}
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case models.DeliveryPending, models.DeliverySucceeded, models.DeliveryFailed:
+			filter["status"] = status
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, succeeded or failed"})
+			return
+		}
+	}
+
+	params, err := parsePageParams(c, maxPageLimit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	page, err := findPage(ctx, db.DeliveriesCol, filter, sort, params, func(d models.WebhookDelivery) bson.D {
+		return bson.D{{Key: "created_at", Value: d.CreatedAt}, {Key: "_id", Value: d.ID}}
+	})
+	if err != nil {
+		if errors.Is(err, errCursorSortMismatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// TestWebhook handles sending a webhook.test delivery right away and returns
+// its outcome. Failed test deliveries are retried like any other.
+func TestWebhook(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout+10*time.Second)
+	defer cancel()
+
+	var webhook models.Webhook
+	if err := db.WebhooksCol.FindOne(ctx, bson.M{"_id": id}).Decode(&webhook); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook"})
+		return
+	}
+	if !webhook.Active {
+		c.JSON(http.StatusConflict, gin.H{"error": "Webhook is paused"})
+		return
+	}
+
+	deliveryID := primitive.NewObjectID()
+	payload, err := json.Marshal(WebhookPayload{
+		ID:        deliveryID.Hex(),
+		Type:      webhookTestEvent,
+		CreatedAt: time.Now(),
+		Data:      gin.H{"webhook_id": webhook.ID.Hex()},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode payload"})
+		return
+	}
+
+	delivery := newDelivery(webhook.ID, nil, webhookTestEvent, payload)
+	delivery.ID = deliveryID
+	// Lease it so the dispatcher leaves it alone while it is sent here
+	lease := time.Now().Add(deliveryLease)
+	delivery.NextAttemptAt = &lease
+	if _, err := db.DeliveriesCol.InsertOne(ctx, delivery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue delivery"})
+		return
+	}
+
+	c.JSON(http.StatusOK, attemptDelivery(ctx, delivery))
+}
+
+// validateWebhookInput checks a webhook's URL and event types, returning them normalized
+func validateWebhookInput(input WebhookInput) (string, []string, error) {
+	u, err := url.Parse(strings.TrimSpace(input.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", nil, errors.New("url must be an absolute http or https URL")
+	}
+
+	events := []string{}
+	seen := map[string]bool{}
+	for _, event := range input.Events {
+		event = strings.TrimSpace(event)
+		if !webhookEventTypes[event] {
+			return "", nil, errors.New("Unknown event type '" + event + "'")
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	return u.String(), events, nil
+}
@@ -4,8 +4,13 @@ package main
 import (
 	"expenses-backend/db"
 	"expenses-backend/handlers"
+	"expenses-backend/notify"
+	"expenses-backend/storage"
 	"log"
 	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezones for expense dates even where the OS has no zoneinfo
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,20 +21,147 @@ func main() {
 	db.InitMongoDB(mongoURI)
 	defer db.CloseMongoDB()
 
+	// Optionally seed exchange rates from a local CSV or JSON file
+	if ratesFile := os.Getenv("EXCHANGE_RATES_FILE"); ratesFile != "" {
+		n, err := handlers.LoadExchangeRatesFile(ratesFile)
+		if err != nil {
+			log.Fatalf("Failed to load exchange rates from %s: %v", ratesFile, err)
+		}
+		log.Printf("Loaded %d exchange rates from %s", n, ratesFile)
+	}
+
+	// Store expense attachments on the local filesystem, or in GridFS with ATTACHMENT_STORAGE=gridfs
+	switch os.Getenv("ATTACHMENT_STORAGE") {
+	case "gridfs":
+		store, err := storage.NewGridFSStore(db.Database, "attachments")
+		if err != nil {
+			log.Fatalf("Failed to open GridFS attachment storage: %v", err)
+		}
+		handlers.SetAttachmentStore(store)
+	case "", "local":
+		dir := os.Getenv("ATTACHMENT_DIR")
+		if dir == "" {
+			dir = "attachments"
+		}
+		handlers.SetAttachmentStore(storage.NewLocalStore(dir))
+	default:
+		log.Fatalf("Unknown ATTACHMENT_STORAGE %q, use local or gridfs", os.Getenv("ATTACHMENT_STORAGE"))
+	}
+
+	// Create the expenses of due recurring expenses in the background
+	handlers.StartRecurringScheduler(time.Minute)
+
+	// Push recorded events to open event streams
+	handlers.StartEventStream()
+
+	// Send queued webhook deliveries and their retries in the background
+	handlers.StartWebhookDispatcher(10 * time.Second)
+
+	// Email expense participants, reminders and weekly digests when SMTP_HOST is set
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		smtpPort := os.Getenv("SMTP_PORT")
+		if smtpPort == "" {
+			smtpPort = "587"
+		}
+		notifier, err := notify.NewSMTPNotifier(smtpHost, smtpPort, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_FROM"))
+		if err != nil {
+			log.Fatalf("Invalid SMTP settings: %v", err)
+		}
+		baseURL := os.Getenv("PUBLIC_URL")
+		if baseURL == "" {
+			baseURL = "http://localhost:8080"
+		}
+		handlers.SetNotifier(notifier, strings.TrimSuffix(baseURL, "/"))
+		handlers.StartDigestScheduler(time.Hour)
+	}
+
 	// Initialize Gin router
 	router := gin.Default()
 
 	// User routes
 	router.POST("/users", handlers.CreateUser)
-	router.GET("/users", handlers.GetUser) // Use query parameter 'identifier'
+	router.GET("/users", handlers.GetUser)            // Use query parameter 'identifier'
+	router.GET("/users/search", handlers.SearchUsers) // Use query parameter 'q'
+	router.PUT("/users/:id", handlers.UpdateUser)
+	router.POST("/users/:id/merge", handlers.RequireAdmin(), handlers.MergeUsers)
 
 	// Expense routes
 	router.POST("/expenses", handlers.AddExpense)
 	router.GET("/expenses/user", handlers.GetUserExpenses) // Use query parameter 'identifier'
-	router.GET("/expenses", handlers.GetOverallExpenses)
+	router.GET("/expenses", handlers.GetOverallExpenses)   // Optional filter and sort query parameters, see README
+
+	// Attachment routes
+	router.POST("/expenses/:id/attachments", handlers.UploadAttachment)                 // Multipart form field 'file'
+	router.GET("/expenses/:id/attachments/:attachment_id", handlers.DownloadAttachment) // Optional query parameter 'thumbnail'
+	router.DELETE("/expenses/:id/attachments/:attachment_id", handlers.DeleteAttachment)
+
+	// Comment routes
+	router.POST("/expenses/:id/comments", handlers.AddComment)
+	router.GET("/expenses/:id/comments", handlers.GetComments) // Use query parameter 'identifier'
+	router.PUT("/expenses/:id/comments/:comment_id", handlers.UpdateComment)
+	router.DELETE("/expenses/:id/comments/:comment_id", handlers.DeleteComment) // Use query parameter 'identifier'
+
+	// Recurring expense routes
+	router.POST("/recurring-expenses", handlers.CreateRecurringExpense)
+	router.GET("/recurring-expenses", handlers.GetRecurringExpenses) // Optional query parameter 'identifier'
+	router.GET("/recurring-expenses/:id", handlers.GetRecurringExpense)
+	router.POST("/recurring-expenses/:id/pause", handlers.PauseRecurringExpense)
+	router.POST("/recurring-expenses/:id/resume", handlers.ResumeRecurringExpense)
+	router.POST("/recurring-expenses/:id/skip", handlers.SkipRecurringExpense)
+	router.DELETE("/recurring-expenses/:id", handlers.DeleteRecurringExpense)
+
+	// Category routes
+	router.PUT("/expenses/:id/category", handlers.SetExpenseCategory)
+	router.POST("/categories", handlers.CreateCategory)
+	router.GET("/categories", handlers.GetCategories) // Optional query parameter 'identifier'
+
+	// Tag routes
+	router.GET("/tags", handlers.GetTags)
+	router.POST("/tags/:tag/rename", handlers.RequireAdmin(), handlers.RenameTag)
+	router.POST("/tags/merge", handlers.RequireAdmin(), handlers.MergeTags)
+
+	// Activity feed
+	router.GET("/activity", handlers.GetActivity) // Use query parameter 'identifier'
+	router.POST("/activity/read", handlers.MarkActivityRead)
+	router.GET("/events/stream", handlers.StreamEvents) // Server-Sent Events, use query parameter 'identifier'
+
+	// Webhooks
+	router.POST("/webhooks", handlers.RequireAdmin(), handlers.CreateWebhook)
+	router.GET("/webhooks", handlers.RequireAdmin(), handlers.GetWebhooks)
+	router.PUT("/webhooks/:id", handlers.RequireAdmin(), handlers.UpdateWebhook)
+	router.DELETE("/webhooks/:id", handlers.RequireAdmin(), handlers.DeleteWebhook)
+	router.GET("/webhooks/:id/deliveries", handlers.RequireAdmin(), handlers.GetWebhookDeliveries) // Optional query parameter 'status'
+	router.POST("/webhooks/:id/test", handlers.RequireAdmin(), handlers.TestWebhook)
+
+	// Settling up
+	router.GET("/settle/:user", handlers.GetSettleUp)
+	router.GET("/settle/:user/qr", handlers.GetSettleQRCode) // Use query parameter 'to', optional 'amount'
+	router.POST("/settlements", handlers.RecordSettlement)
+	router.GET("/settlements", handlers.GetSettlements) // Use query parameter 'identifier'
+
+	// Budgets
+	router.POST("/budgets", handlers.CreateBudget)
+	router.GET("/budgets", handlers.GetBudgets)                 // Use query parameter 'identifier'
+	router.GET("/budgets/:id/status", handlers.GetBudgetStatus) // Optional query parameter 'month' (YYYY-MM)
+	router.PUT("/budgets/:id", handlers.UpdateBudget)
+	router.DELETE("/budgets/:id", handlers.DeleteBudget)
+
+	// Email notifications
+	router.POST("/reminders", handlers.SendReminder)
+	router.GET("/notifications/preferences", handlers.GetEmailPreferences) // Use query parameter 'identifier'
+	router.PUT("/notifications/preferences", handlers.UpdateEmailPreferences)
+	router.GET("/notifications/unsubscribe", handlers.ConfirmUnsubscribe) // Use query parameters 'token' and optional 'type'
+	router.POST("/notifications/unsubscribe", handlers.Unsubscribe)
+
+	// Exchange rates
+	router.GET("/exchange-rates", handlers.GetExchangeRates)
+	router.POST("/exchange-rates", handlers.RequireAdmin(), handlers.ImportExchangeRates)
 
 	// Balance Sheet
-	router.GET("/balancesheet/download", handlers.DownloadBalanceSheet)
+	router.GET("/balancesheet/download", handlers.DownloadBalanceSheet) // Optional query parameter 'convert_to'
+
+	// Reports
+	router.GET("/reports/spending", handlers.GetSpendingReport) // Optional query parameters, see README
 
 	// Start server
 	port := os.Getenv("PORT")
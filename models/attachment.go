@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Attachment is a file such as a bill photo attached to an expense. Its
+// contents live in blob storage, not in the expense document.
+type Attachment struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	FileName     string             `bson:"file_name" json:"file_name"`
+	ContentType  string             `bson:"content_type" json:"content_type"`
+	Size         int64              `bson:"size" json:"size"`
+	HasThumbnail bool               `bson:"has_thumbnail" json:"has_thumbnail"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
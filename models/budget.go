@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BudgetThresholds are the percentages of a budget at which its owner is alerted
+var BudgetThresholds = []int{80, 100}
+
+// Budget limits a user's monthly share of expenses in one currency, optionally
+// only of expenses in one category
+type Budget struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	User     primitive.ObjectID `bson:"user" json:"user"`
+	Category string             `bson:"category,omitempty" json:"category,omitempty"`
+	Amount   float64            `bson:"amount" json:"amount"`
+	Currency string             `bson:"currency" json:"currency"`
+	// Timezone is the IANA zone months start in; UTC when empty
+	Timezone string `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	// Alerts records the thresholds already alerted, as "<month>:<percent>" e.g. "2026-10:80"
+	Alerts    []string  `bson:"alerts,omitempty" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
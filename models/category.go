@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Category classifies expenses. Built-in categories have no owner; custom
+// categories belong to the user who created them.
+type Category struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name      string             `bson:"name" json:"name"`
+	CreatedBy primitive.ObjectID `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	Custom    bool               `bson:"-" json:"custom"`
+	CreatedAt time.Time          `bson:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+// DefaultCategory is assigned to expenses without a category
+const DefaultCategory = "other"
+
+// BuiltinCategories is the fixed taxonomy available to every user
+var BuiltinCategories = []string{
+	"food",
+	"groceries",
+	"travel",
+	"transport",
+	"rent",
+	"utilities",
+	"entertainment",
+	"shopping",
+	"health",
+	"education",
+	"household",
+	"gifts",
+	DefaultCategory,
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Comment is a message in the discussion thread of an expense
+type Comment struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ExpenseID primitive.ObjectID `bson:"expense_id" json:"expense_id"`
+	Author    primitive.ObjectID `bson:"author" json:"author"`
+	Text      string             `bson:"text" json:"text"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+	// EditedAt is set once the author has changed the text
+	EditedAt *time.Time `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+}
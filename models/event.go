@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event types recorded by the write handlers
+const (
+	EventUserCreated       = "user.created"
+	EventUserUpdated       = "user.updated"
+	EventUserMerged        = "user.merged"
+	EventExpenseCreated    = "expense.created"
+	EventExpenseUpdated    = "expense.updated"
+	EventCommentCreated    = "comment.created"
+	EventCommentUpdated    = "comment.updated"
+	EventCommentDeleted    = "comment.deleted"
+	EventReminderSent      = "reminder.sent"
+	EventSettlementCreated = "settlement.created"
+	EventBudgetThreshold   = "budget.threshold_crossed"
+)
+
+// Event records something that happened, for the activity feed of every user in Users
+type Event struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Type string             `bson:"type" json:"type"`
+	// Actor is the user who caused the event, if known
+	Actor *primitive.ObjectID `bson:"actor,omitempty" json:"actor,omitempty"`
+	// Users are the users the event concerns
+	Users     []primitive.ObjectID `bson:"users" json:"users"`
+	ExpenseID *primitive.ObjectID  `bson:"expense_id,omitempty" json:"expense_id,omitempty"`
+	// Data holds a summary of the change, e.g. the expense's description and amount
+	Data      bson.M    `bson:"data,omitempty" json:"data,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
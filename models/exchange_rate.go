@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ExchangeRate converts one unit of From into Rate units of To from EffectiveDate onwards
+type ExchangeRate struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	From          string             `bson:"from" json:"from"`
+	To            string             `bson:"to" json:"to"`
+	Rate          float64            `bson:"rate" json:"rate"`
+	EffectiveDate time.Time          `bson:"effective_date" json:"effective_date"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+}
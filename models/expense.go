@@ -7,12 +7,42 @@ import (
 )
 
 type Expense struct {
-    ID           primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
-    Description  string                 `bson:"description" json:"description" validate:"required"`
-    Amount       float64                `bson:"amount" json:"amount" validate:"required,gt=0"`
-    CreatedBy    primitive.ObjectID     `bson:"created_by" json:"created_by" validate:"required"`
-    SplitType    string                 `bson:"split_type" json:"split_type" validate:"required,oneof=Equal Exact Percentage"`
-    Participants []primitive.ObjectID   `bson:"participants" json:"participants" validate:"required,min=1"`
-    SplitDetails map[string]interface{} `bson:"split_details,omitempty" json:"split_details,omitempty"`
-    CreatedAt    time.Time              `bson:"created_at" json:"created_at"`
+    ID             primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+    Description    string                 `bson:"description" json:"description" validate:"required"`
+    Amount         float64                `bson:"amount" json:"amount" validate:"required,gt=0"`
+    Currency       string                 `bson:"currency" json:"currency"`
+    Category       string                 `bson:"category" json:"category"`
+    CategorySource string                 `bson:"category_source,omitempty" json:"category_source,omitempty"` // "user", "suggested" or "default"
+    Tags           []string               `bson:"tags,omitempty" json:"tags,omitempty"`
+    CreatedBy      primitive.ObjectID     `bson:"created_by" json:"created_by" validate:"required"`
+    SplitType      string                 `bson:"split_type" json:"split_type" validate:"required,oneof=Equal Exact Percentage"`
+    Participants   []primitive.ObjectID   `bson:"participants" json:"participants" validate:"required,min=1"`
+    SplitDetails   map[string]interface{} `bson:"split_details,omitempty" json:"split_details,omitempty"`
+    ExpenseDate    time.Time              `bson:"expense_date" json:"expense_date"`
+    Timezone       string                 `bson:"timezone,omitempty" json:"timezone,omitempty"`
+    CommentCount   int                    `bson:"comment_count,omitempty" json:"comment_count"`
+    Attachments    []Attachment           `bson:"attachments,omitempty" json:"attachments,omitempty"`
+    RecurringID    *primitive.ObjectID    `bson:"recurring_id,omitempty" json:"recurring_id,omitempty"` // Set on expenses created by a recurring expense
+    CreatedAt      time.Time              `bson:"created_at" json:"created_at"`
+    UpdatedAt      time.Time              `bson:"updated_at,omitempty" json:"updated_at"`
+}
+
+// Date returns when the expense happened, falling back to its creation time
+// for expenses recorded before expense_date existed
+func (e Expense) Date() time.Time {
+    if e.ExpenseDate.IsZero() {
+        return e.CreatedAt
+    }
+    return e.ExpenseDate
+}
+
+// Day returns the calendar day of the expense in its own timezone, as midnight UTC
+func (e Expense) Day() time.Time {
+    date := e.Date()
+    if loc, err := time.LoadLocation(e.Timezone); err == nil && e.Timezone != "" {
+        date = date.In(loc)
+    } else {
+        date = date.UTC()
+    }
+    return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
 }
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RecurringExpense materializes an expense from Template on every occurrence of Schedule
+type RecurringExpense struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Template  ExpenseTemplate    `bson:"template" json:"template"`
+	Schedule  Schedule           `bson:"schedule" json:"schedule"`
+	CreatedBy primitive.ObjectID `bson:"created_by" json:"created_by"`
+	// NextIndex is the zero-based number of the next occurrence to materialize or skip
+	NextIndex int `bson:"next_index" json:"next_index"`
+	// NextRun is the date of the next occurrence; nil once the schedule has ended
+	NextRun   *time.Time  `bson:"next_run,omitempty" json:"next_run,omitempty"`
+	Paused    bool        `bson:"paused" json:"paused"`
+	Skipped   []time.Time `bson:"skipped,omitempty" json:"skipped,omitempty"`
+	LastRunAt *time.Time  `bson:"last_run_at,omitempty" json:"last_run_at,omitempty"`
+	// LastError is why the last occurrence could not be created, if it failed
+	LastError string    `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// ExpenseTemplate holds the fields of the expenses a RecurringExpense creates.
+// Users are stored by ID so later email or mobile changes don't break it.
+type ExpenseTemplate struct {
+	Description  string                 `bson:"description" json:"description"`
+	Amount       float64                `bson:"amount" json:"amount"`
+	Currency     string                 `bson:"currency" json:"currency"`
+	Category     string                 `bson:"category,omitempty" json:"category,omitempty"`
+	Tags         []string               `bson:"tags,omitempty" json:"tags,omitempty"`
+	CreatedBy    string                 `bson:"created_by" json:"created_by"`
+	SplitType    string                 `bson:"split_type" json:"split_type"`
+	Participants []string               `bson:"participants" json:"participants"`
+	SplitDetails map[string]interface{} `bson:"split_details,omitempty" json:"split_details,omitempty"`
+}
+
+// Schedule is an RRULE-like recurrence: every Interval weeks on Weekday,
+// months on MonthDay, or years on Month/MonthDay, starting at StartDate
+type Schedule struct {
+	Frequency string `bson:"frequency" json:"frequency"` // "weekly", "monthly" or "yearly"
+	Interval  int    `bson:"interval" json:"interval"`
+	// Weekday is 0 (Sunday) to 6 (Saturday) for weekly schedules
+	Weekday *int `bson:"weekday,omitempty" json:"weekday,omitempty"`
+	// MonthDay is 1 to 31 for monthly and yearly schedules, clamped to the month's last day
+	MonthDay int `bson:"month_day,omitempty" json:"month_day,omitempty"`
+	// Month is 1 to 12 for yearly schedules
+	Month     int        `bson:"month,omitempty" json:"month,omitempty"`
+	StartDate time.Time  `bson:"start_date" json:"start_date"`
+	EndDate   *time.Time `bson:"end_date,omitempty" json:"end_date,omitempty"`
+	// Count limits the number of occurrences, 0 for no limit
+	Count    int    `bson:"count,omitempty" json:"count,omitempty"`
+	Timezone string `bson:"timezone" json:"timezone"`
+}
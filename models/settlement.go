@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Settlement methods
+const (
+	SettlementUPI   = "upi"
+	SettlementCash  = "cash"
+	SettlementOther = "other"
+)
+
+// Settlement records a payment from one user to another that settles what the payer owed
+type Settlement struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Payer    primitive.ObjectID `bson:"payer" json:"payer"`
+	Payee    primitive.ObjectID `bson:"payee" json:"payee"`
+	Amount   float64            `bson:"amount" json:"amount"`
+	Currency string             `bson:"currency" json:"currency"`
+	Method   string             `bson:"method" json:"method"`
+	// Reference is the payment's transaction reference, e.g. the UPI reference number
+	Reference string    `bson:"reference,omitempty" json:"reference,omitempty"`
+	Note      string    `bson:"note,omitempty" json:"note,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
@@ -7,9 +7,44 @@ import (
 )
 
 type User struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Name         string             `bson:"name" json:"name" validate:"required"`
-	Email        string             `bson:"email" json:"email" validate:"required,email"`
-	MobileNumber string             `bson:"mobile_number" json:"mobile_number" validate:"required"`
-	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	ID                    primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	Name                  string               `bson:"name" json:"name" validate:"required"`
+	Email                 string               `bson:"email" json:"email" validate:"required,email"`
+	MobileNumber          string               `bson:"mobile_number" json:"mobile_number" validate:"required"`
+	UPIVPA                string               `bson:"upi_vpa,omitempty" json:"upi_vpa,omitempty"` // UPI address payments to the user go to, e.g. priya@okaxis
+	PreviousEmails        []PreviousIdentifier `bson:"previous_emails,omitempty" json:"-"`
+	PreviousMobileNumbers []PreviousIdentifier `bson:"previous_mobile_numbers,omitempty" json:"-"`
+	Placeholder           bool                 `bson:"placeholder,omitempty" json:"placeholder,omitempty"`
+	ClaimedAt             *time.Time           `bson:"claimed_at,omitempty" json:"claimed_at,omitempty"`
+	MergedInto            *primitive.ObjectID  `bson:"merged_into,omitempty" json:"merged_into,omitempty"`
+	MergedAt              *time.Time           `bson:"merged_at,omitempty" json:"merged_at,omitempty"`
+	ActivityReadAt        *time.Time           `bson:"activity_read_at,omitempty" json:"-"` // When the activity feed was last marked read
+	EmailPreferences      *EmailPreferences    `bson:"email_preferences,omitempty" json:"-"`
+	UnsubscribeToken      string               `bson:"unsubscribe_token,omitempty" json:"-"`
+	LastDigestAt          *time.Time           `bson:"last_digest_at,omitempty" json:"-"`
+	LastSettlementAt      *time.Time           `bson:"last_settlement_at,omitempty" json:"-"` // Written by each settlement the user pays, so concurrent ones conflict
+	RemindersSentAt       map[string]time.Time `bson:"reminders_sent_at,omitempty" json:"-"`  // When the user last reminded each debtor, keyed by their id
+	CreatedAt             time.Time            `bson:"created_at" json:"created_at"`
+	UpdatedAt             time.Time            `bson:"updated_at,omitempty" json:"updated_at"`
+}
+
+// PreviousIdentifier records an email or mobile number a user has replaced
+type PreviousIdentifier struct {
+	Value      string    `bson:"value" json:"value"`
+	ReplacedAt time.Time `bson:"replaced_at" json:"replaced_at"`
+}
+
+// EmailPreferences records which emails a user wants to receive
+type EmailPreferences struct {
+	ExpenseAdded bool `bson:"expense_added" json:"expense_added"`
+	Reminders    bool `bson:"reminders" json:"reminders"`
+	Digest       bool `bson:"digest" json:"digest"`
+}
+
+// Preferences returns the user's email preferences, defaulting to every email
+func (u User) Preferences() EmailPreferences {
+	if u.EmailPreferences == nil {
+		return EmailPreferences{ExpenseAdded: true, Reminders: true, Digest: true}
+	}
+	return *u.EmailPreferences
 }
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a subscription that receives the given event types as signed JSON POSTs
+type Webhook struct {
+	ID  primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URL string             `bson:"url" json:"url"`
+	// Secret signs payloads; it is only shown when the webhook is created
+	Secret    string    `bson:"secret" json:"-"`
+	Events    []string  `bson:"events" json:"events"`
+	Active    bool      `bson:"active" json:"active"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// WebhookDelivery is one payload queued for a webhook, with its delivery attempts
+type WebhookDelivery struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	WebhookID primitive.ObjectID  `bson:"webhook_id" json:"webhook_id"`
+	EventID   *primitive.ObjectID `bson:"event_id,omitempty" json:"event_id,omitempty"`
+	EventType string              `bson:"event_type" json:"event_type"`
+	// Payload is the exact JSON body that is signed and sent
+	Payload       string            `bson:"payload" json:"payload"`
+	Status        string            `bson:"status" json:"status"`
+	Attempts      []DeliveryAttempt `bson:"attempts" json:"attempts"`
+	NextAttemptAt *time.Time        `bson:"next_attempt_at,omitempty" json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time        `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	CreatedAt     time.Time         `bson:"created_at" json:"created_at"`
+}
+
+// DeliveryAttempt is the outcome of one POST of a webhook delivery
+type DeliveryAttempt struct {
+	At         time.Time `bson:"at" json:"at"`
+	StatusCode int       `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	// Response is the start of the receiver's response body
+	Response   string `bson:"response,omitempty" json:"response,omitempty"`
+	DurationMs int64  `bson:"duration_ms" json:"duration_ms"`
+}
@@ -0,0 +1,18 @@
+package notify
+
+import "context"
+
+// Message is an email with plain text and HTML alternatives
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// Headers are extra headers such as List-Unsubscribe
+	Headers map[string]string
+}
+
+// Notifier delivers messages to users
+type Notifier interface {
+	Send(ctx context.Context, msg Message) error
+}
@@ -0,0 +1,177 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts one SMTP session without STARTTLS or AUTH and records it
+type fakeSMTPServer struct {
+	listener net.Listener
+	done     chan struct{}
+	from     string
+	rcpt     []string
+	data     string
+	err      error
+}
+
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &fakeSMTPServer{listener: listener, done: make(chan struct{})}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) serve() {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		s.err = err
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP test")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			s.err = err
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			s.from = line
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			s.rcpt = append(s.rcpt, line)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				s.err = err
+				return
+			}
+			s.data = string(data)
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPNotifierSend(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+
+	notifier, err := NewSMTPNotifier(host, port, "", "", "Expenses <expenses@example.com>")
+	if err != nil {
+		t.Fatalf("NewSMTPNotifier: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = notifier.Send(ctx, Message{
+		To:      "Priya <priya.sharma@example.com>",
+		Subject: "Reminder from Rahul – Goa",
+		Text:    "You owe 1250 INR",
+		HTML:    "<p>You owe <strong>1250 INR</strong></p>",
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<http://localhost:8080/notifications/unsubscribe?token=abc>",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-server.done
+	if server.err != nil {
+		t.Fatalf("server: %v", server.err)
+	}
+
+	if server.from != "MAIL FROM:<expenses@example.com>" {
+		t.Errorf("got sender %q", server.from)
+	}
+	if len(server.rcpt) != 1 || server.rcpt[0] != "RCPT TO:<priya.sharma@example.com>" {
+		t.Errorf("got recipients %q", server.rcpt)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(server.data))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Reminder from Rahul – Goa" {
+		t.Errorf("got subject %q (%v)", subject, err)
+	}
+	for name, want := range map[string]string{
+		"From":                  "Expenses <expenses@example.com>",
+		"To":                    "Priya <priya.sharma@example.com>",
+		"List-Unsubscribe":      "<http://localhost:8080/notifications/unsubscribe?token=abc>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	} {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+	if !strings.HasSuffix(msg.Header.Get("Message-ID"), "@example.com>") {
+		t.Errorf("got Message-ID %q", msg.Header.Get("Message-ID"))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		// The reader undoes the quoted-printable encoding
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		parts[part.Header.Get("Content-Type")] = string(body)
+	}
+	if got := parts["text/plain; charset=utf-8"]; got != "You owe 1250 INR" {
+		t.Errorf("got text part %q", got)
+	}
+	if got := parts["text/html; charset=utf-8"]; got != "<p>You owe <strong>1250 INR</strong></p>" {
+		t.Errorf("got HTML part %q", got)
+	}
+}
+
+func TestSMTPNotifierRejectsHeaderInjection(t *testing.T) {
+	notifier := &SMTPNotifier{Host: "127.0.0.1", Port: "1", From: "expenses@example.com"}
+	err := notifier.Send(context.Background(), Message{To: "priya@example.com", Subject: "Hi\r\nBcc: someone@example.com", Text: "x"})
+	if err == nil || !strings.Contains(err.Error(), "line breaks") {
+		t.Errorf("got %v, want a line break error", err)
+	}
+}
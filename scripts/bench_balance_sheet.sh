@@ -0,0 +1,104 @@
+#!/bin/bash
+
+# Seeds MongoDB with generated users and expenses, times the balance sheet
+# download against the running server and removes the seeded data again.
+#
+# Usage: ./bench_balance_sheet.sh [users] [expenses]
+# Environment: MONGO_URI, API_URL, RUNS, KEEP_SEED=1 to leave the data in place
+
+# Ensure the script exits if any command fails
+set -e
+
+USERS=${1:-2000}
+EXPENSES=${2:-50000}
+RUNS=${RUNS:-5}
+MONGO_URI=${MONGO_URI:-mongodb://localhost:27017/expenses_db}
+API_URL=${API_URL:-http://localhost:8080}
+
+# Seeded users all have an email at this domain
+SEED_DOMAIN="bench.example.com"
+
+# Function to print status messages
+print_status() {
+  echo -e "\n=== $1 ==="
+}
+
+remove_seed() {
+  mongosh --quiet "$MONGO_URI" --eval "
+    const ids = db.users.find({ email: /@bench\\.example\\.com\$/ }, { _id: 1 }).toArray().map(u => u._id);
+    const expenses = db.expenses.deleteMany({ created_by: { \$in: ids } }).deletedCount;
+    const users = db.users.deleteMany({ _id: { \$in: ids } }).deletedCount;
+    print('Removed ' + users + ' users and ' + expenses + ' expenses');
+  "
+}
+
+# 1. Seed users and expenses, replacing any left by an earlier run
+print_status "Seeding $USERS users and $EXPENSES expenses"
+remove_seed
+
+mongosh --quiet "$MONGO_URI" --eval "
+  const now = new Date();
+  const users = [];
+  for (let i = 0; i < $USERS; i++) {
+    users.push({
+      _id: new ObjectId(),
+      name: 'Bench User ' + i,
+      email: 'user' + i + '@$SEED_DOMAIN',
+      mobile_number: String(7000000000 + i),
+      created_at: now,
+      updated_at: now,
+    });
+  }
+  db.users.insertMany(users);
+
+  const currencies = ['INR', 'INR', 'INR', 'USD', 'THB'];
+  const categories = ['food', 'travel', 'rent', 'groceries', ''];
+  let batch = [];
+  for (let i = 0; i < $EXPENSES; i++) {
+    const participants = [];
+    const size = 2 + Math.floor(Math.random() * 4);
+    while (participants.length < size) {
+      const id = users[Math.floor(Math.random() * users.length)]._id;
+      if (!participants.some(p => p.equals(id))) {
+        participants.push(id);
+      }
+    }
+    const amount = Math.round(Math.random() * 500000) / 100;
+    const splitDetails = {};
+    participants.forEach(p => { splitDetails[p.toHexString()] = Math.round(amount / size * 100) / 100; });
+    const date = new Date(now.getTime() - Math.floor(Math.random() * 365) * 86400000);
+    batch.push({
+      description: 'Bench expense ' + i,
+      amount: amount,
+      currency: currencies[i % currencies.length],
+      category: categories[i % categories.length],
+      created_by: participants[0],
+      split_type: 'Equal',
+      participants: participants,
+      split_details: splitDetails,
+      expense_date: date,
+      created_at: date,
+    });
+    if (batch.length === 1000) {
+      db.expenses.insertMany(batch);
+      batch = [];
+    }
+  }
+  if (batch.length > 0) {
+    db.expenses.insertMany(batch);
+  }
+  print('Seeded ' + users.length + ' users and $EXPENSES expenses');
+"
+
+# 2. Time the balance sheet download
+print_status "Downloading the balance sheet $RUNS times"
+
+for i in $(seq "$RUNS"); do
+  curl -s -f -o /dev/null -w "%{time_total}\n" "$API_URL/balancesheet/download"
+done | awk '{ print "Run " NR ": " $1 "s"; total += $1 } END { printf "Average: %.3fs\n", total / NR }'
+
+# 3. Clean up
+if [ "$KEEP_SEED" != "1" ]; then
+  print_status "Removing seeded data"
+  remove_seed
+fi
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GridFSStore keeps blobs in a MongoDB GridFS bucket, using the key as the file ID
+type GridFSStore struct {
+	Bucket *gridfs.Bucket
+}
+
+// NewGridFSStore opens the named GridFS bucket of database
+func NewGridFSStore(database *mongo.Database, bucketName string) (*GridFSStore, error) {
+	bucket, err := gridfs.NewBucket(database, options.GridFSBucket().SetName(bucketName))
+	if err != nil {
+		return nil, err
+	}
+	return &GridFSStore{Bucket: bucket}, nil
+}
+
+func (s *GridFSStore) Put(ctx context.Context, key string, r io.Reader) error {
+	// Replace an existing blob, as the filesystem store does
+	if err := s.Delete(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return s.Bucket.UploadFromStreamWithID(key, key, r)
+}
+
+func (s *GridFSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	stream, err := s.Bucket.OpenDownloadStream(key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *GridFSStore) Delete(ctx context.Context, key string) error {
+	err := s.Bucket.DeleteContext(ctx, key)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when no blob exists under a key
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore stores opaque blobs such as expense attachments under
+// slash-separated keys like "expenses/<id>/<attachment id>"
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the blob's contents, which the caller must close
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes a blob; deleting a missing blob returns ErrNotFound
+	Delete(ctx context.Context, key string) error
+}
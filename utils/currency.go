@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DefaultCurrency is used for expenses that don't specify a currency
+const DefaultCurrency = "INR"
+
+// currencyMinorUnits maps supported ISO 4217 codes to their number of decimal places
+var currencyMinorUnits = map[string]int{
+	"AED": 2, "AUD": 2, "BDT": 2, "BHD": 3, "BRL": 2, "BTN": 2, "CAD": 2, "CHF": 2,
+	"CLP": 0, "CNY": 2, "CZK": 2, "DKK": 2, "EGP": 2, "EUR": 2, "GBP": 2, "HKD": 2,
+	"HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "ISK": 0, "JOD": 3, "JPY": 0, "KES": 2,
+	"KHR": 2, "KRW": 0, "KWD": 3, "LAK": 2, "LKR": 2, "MMK": 2, "MVR": 2, "MXN": 2,
+	"MYR": 2, "NGN": 2, "NOK": 2, "NPR": 2, "NZD": 2, "OMR": 3, "PHP": 2, "PKR": 2,
+	"PLN": 2, "QAR": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2, "TRY": 2, "TWD": 2,
+	"UGX": 0, "USD": 2, "VND": 0, "XAF": 0, "XOF": 0, "ZAR": 2,
+}
+
+// NormalizeCurrency upper-cases a currency code, defaulting to DefaultCurrency when empty
+func NormalizeCurrency(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return DefaultCurrency
+	}
+	return code
+}
+
+// MinorUnits returns the number of decimal places of a supported currency
+func MinorUnits(code string) (int, bool) {
+	units, ok := currencyMinorUnits[code]
+	return units, ok
+}
+
+// HasValidPrecision checks that amount has no more decimal places than the currency allows
+func HasValidPrecision(amount float64, code string) bool {
+	units, ok := currencyMinorUnits[code]
+	if !ok {
+		return false
+	}
+	scaled := amount * math.Pow10(units)
+	return AlmostEqual(scaled, math.Round(scaled), 1e-6)
+}
+
+// RoundAmount rounds amount to the currency's number of decimal places
+func RoundAmount(amount float64, code string) float64 {
+	units, ok := currencyMinorUnits[code]
+	if !ok {
+		units = 2
+	}
+	scale := math.Pow10(units)
+	return math.Round(amount*scale) / scale
+}
+
+// FormatAmount formats amount with the currency's number of decimal places
+func FormatAmount(amount float64, code string) string {
+	units, ok := currencyMinorUnits[code]
+	if !ok {
+		units = 2
+	}
+	return fmt.Sprintf("%.*f", units, amount)
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // Register decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+)
+
+// maxThumbnailSourcePixels guards against decompressing huge images
+const maxThumbnailSourcePixels = 25_000_000
+
+var ErrImageTooLarge = errors.New("image is too large to thumbnail")
+
+// Thumbnail decodes a JPEG, PNG or GIF image and returns it as a JPEG scaled
+// to fit within maxSide pixels. Transparent areas become white.
+func Thumbnail(data []byte, maxSide int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, ErrImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return nil, errors.New("image is empty")
+	}
+	tw, th := w, h
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			tw, th = maxSide, max(1, h*maxSide/w)
+		} else {
+			tw, th = max(1, w*maxSide/h), maxSide
+		}
+	}
+
+	// Box filter: each thumbnail pixel averages the source pixels it covers
+	dst := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0 := bounds.Min.Y + y*h/th
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*h/th)
+		for x := 0; x < tw; x++ {
+			x0 := bounds.Min.X + x*w/tw
+			x1 := max(x0+1, bounds.Min.X+(x+1)*w/tw)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// Colors are alpha-premultiplied, so compositing over white adds the missing coverage
+			white := 0xffff - a/n
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}